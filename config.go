@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	input "github.com/quasilyte/ebitengine-input"
+)
+
+// Config is the configuration file. Key names are those of ebitengine-input,
+// like "x", "ctrl+x", "gamepad_a" or "gamepad_lstick_up".
+type Config struct {
+	Player1 map[string][]string `json:"player1"` // Keys for each NES button on controller 1
+	Player2 map[string][]string `json:"player2"` // Keys for each NES button on controller 2
+}
+
+// buttonNames are the names of the NES buttons in the config file.
+var buttonNames = map[input.Action]string{
+	ActionA:      "a",
+	ActionB:      "b",
+	ActionSelect: "select",
+	ActionStart:  "start",
+	ActionUp:     "up",
+	ActionDown:   "down",
+	ActionLeft:   "left",
+	ActionRight:  "right",
+}
+
+// defaultConfigPath returns the path of the configuration file in the user's
+// configuration directory.
+func defaultConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "smolnes-go", "config.json"), nil
+}
+
+// defaultConfig returns the configuration with the built-in key bindings.
+func defaultConfig() *Config {
+	return &Config{Player1: keymapConfig(keymap), Player2: keymapConfig(keymap2)}
+}
+
+func keymapConfig(km input.Keymap) map[string][]string {
+	m := make(map[string][]string)
+	for _, a := range nesBtns {
+		names := []string{}
+		for _, k := range km[a] {
+			names = append(names, k.String())
+		}
+		m[buttonNames[a]] = names
+	}
+	return m
+}
+
+// loadConfig reads the configuration file at path. If it doesn't exist, it is
+// created with the defaults. Players missing from the file get the default
+// bindings.
+func loadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		c := defaultConfig()
+		b, err := json.MarshalIndent(c, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(path, append(b, '\n')); err != nil {
+			return nil, fmt.Errorf("failed to write default config: %w", err)
+		}
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	def := defaultConfig()
+	if c.Player1 == nil {
+		c.Player1 = def.Player1
+	}
+	if c.Player2 == nil {
+		c.Player2 = def.Player2
+	}
+	return c, nil
+}
+
+// parseKeymap converts the key names for each NES button into a keymap.
+// Buttons that are left out have no keys.
+func parseKeymap(m map[string][]string) (input.Keymap, error) {
+	actions := make(map[string]input.Action, len(buttonNames))
+	for a, name := range buttonNames {
+		actions[name] = a
+	}
+
+	km := input.Keymap{}
+	for name, keys := range m {
+		a, ok := actions[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown NES button %q", name)
+		}
+		for _, s := range keys {
+			k, err := input.ParseKey(s)
+			if err != nil {
+				return nil, fmt.Errorf("button %q: %w", name, err)
+			}
+			km[a] = append(km[a], k)
+		}
+	}
+	return km, nil
+}
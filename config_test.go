@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	input "github.com/quasilyte/ebitengine-input"
+)
+
+func TestLoadConfig(t *testing.T) {
+	def := defaultConfig()
+	tests := []struct {
+		name    string
+		file    string // Contents of the config file, "" if there is none
+		want    *Config
+		wantErr bool
+	}{
+		{name: "first run", want: def},
+		{name: "both players", file: `{"player1": {"a": ["z"]}, "player2": {"b": ["x"]}}`, want: &Config{
+			Player1: map[string][]string{"a": {"z"}},
+			Player2: map[string][]string{"b": {"x"}},
+		}},
+		{name: "no player2", file: `{"player1": {"a": ["z"]}}`, want: &Config{
+			Player1: map[string][]string{"a": {"z"}},
+			Player2: def.Player2,
+		}},
+		{name: "empty", file: `{}`, want: def},
+		{name: "bad JSON", file: `{"player1": `, wantErr: true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "smolnes-go", "config.json")
+		if tt.file != "" {
+			if err := writeFileAtomic(path, []byte(tt.file)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c, err := loadConfig(path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: loadConfig() error = %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(c, tt.want) {
+			t.Errorf("%s: loadConfig() = %+v, want %+v", tt.name, c, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigWritesDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smolnes-go", "config.json")
+	if _, err := loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("default config not written: %v", err)
+	}
+	// The second run reads the file written by the first.
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, defaultConfig()) {
+		t.Errorf("config written on first run = %+v, want the defaults", c)
+	}
+}
+
+func TestParseKeymap(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       map[string][]string
+		want    input.Keymap
+		wantErr string
+	}{
+		{"keys", map[string][]string{"a": {"x", "gamepad_a"}, "start": {"enter"}}, input.Keymap{
+			ActionA:     {input.KeyX, input.KeyGamepadA},
+			ActionStart: {input.KeyEnter},
+		}, ""},
+		{"no keys", map[string][]string{"b": {}}, input.Keymap{}, ""},
+		{"unknown button", map[string][]string{"turbo": {"x"}}, nil, `unknown NES button "turbo"`},
+		{"bad key", map[string][]string{"a": {"nosuchkey"}}, nil, `button "a"`},
+	}
+	for _, tt := range tests {
+		km, err := parseKeymap(tt.m)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: parseKeymap() error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseKeymap() error = %v", tt.name, err)
+		} else if !reflect.DeepEqual(km, tt.want) {
+			t.Errorf("%s: parseKeymap() = %v, want %v", tt.name, km, tt.want)
+		}
+	}
+}
+
+func TestKeymapConfigRoundTrip(t *testing.T) {
+	for i, km := range []input.Keymap{keymap, keymap2} {
+		got, err := parseKeymap(keymapConfig(km))
+		if err != nil {
+			t.Fatalf("keymap %d: %v", i+1, err)
+		}
+		if !reflect.DeepEqual(got, km) {
+			t.Errorf("keymap %d: parseKeymap(keymapConfig(km)) = %v, want %v", i+1, got, km)
+		}
+	}
+}
@@ -3,5 +3,33 @@ package main
 import "flag"
 
 var (
-	logLevelFlag = flag.String("log-level", "info", "Log level (\"debug\", \"info\", \"warn\", \"error\")")
+	configFlag          = flag.String("config", "", "Path to the config file with key bindings, created with the defaults if missing (default: smolnes-go/config.json in the user config directory)")
+	logLevelFlag        = flag.String("log-level", "info", "Log level (\"debug\", \"info\", \"warn\", \"error\")")
+	regionFlag          = flag.String("region", "auto", "Console region (\"auto\", \"ntsc\", \"pal\", \"dendy\")")
+	overscanTopFlag     = flag.Int("overscan-top", 8, "Number of lines to crop from the top of the frame")
+	overscanBottomFlag  = flag.Int("overscan-bottom", 8, "Number of lines to crop from the bottom of the frame")
+	overscanLeftFlag    = flag.Int("overscan-left", 0, "Number of columns to crop from the left of the frame")
+	overscanRightFlag   = flag.Int("overscan-right", 0, "Number of columns to crop from the right of the frame")
+	paletteFlag         = flag.String("palette", "default", "Built-in palette (\"default\", \"2c03\", \"composite\") or path to a .pal file")
+	hueFlag             = flag.Float64("hue", DefaultPaletteParams.Hue, "Hue rotation of the composite palette in degrees")
+	saturationFlag      = flag.Float64("saturation", DefaultPaletteParams.Saturation, "Saturation of the composite palette")
+	contrastFlag        = flag.Float64("contrast", DefaultPaletteParams.Contrast, "Contrast of the composite palette")
+	brightnessFlag      = flag.Float64("brightness", DefaultPaletteParams.Brightness, "Brightness of the composite palette")
+	gammaFlag           = flag.Float64("gamma", DefaultPaletteParams.Gamma, "Signal gamma of the composite palette")
+	ntscFlag            = flag.String("ntsc", "off", "NTSC filter preset (\"off\", \"composite\", \"svideo\", \"rgb\", \"monochrome\")")
+	noSpriteLimitFlag   = flag.Bool("no-sprite-limit", false, "Draw more than 8 sprites per scanline to reduce flicker")
+	saveDirFlag         = flag.String("save-dir", "", "Directory for battery-backed save files and save states (default: next to the ROM file)")
+	fastForwardFlag     = flag.Float64("fast-forward", 4, "Speed multiplier while holding ` to fast-forward, 0 for uncapped")
+	slowMotionFlag      = flag.Float64("slow-motion", 0.5, "Speed multiplier in slow motion, toggled with F4")
+	recordMovieFlag     = flag.String("record-movie", "", "Record input from power-on to an FM2 movie file")
+	playMovieFlag       = flag.String("play-movie", "", "Play back an FM2 movie file from power-on")
+	headlessFlag        = flag.Bool("headless", false, "Run -play-movie without a window and exit when it ends")
+	hashesFlag          = flag.String("hashes", "", "With -headless, write per-frame video and RAM hashes to this file (\"-\" for stdout)")
+	goldenFlag          = flag.String("golden", "", "With -headless, compare per-frame hashes with this file and fail on the first mismatch")
+	screenshotDirFlag   = flag.String("screenshot-dir", "", "Directory for F12 screenshots, F9 video recordings and F10 GIFs (default: next to the ROM file)")
+	screenshotScaleFlag = flag.Int("screenshot-scale", 1, "Integer scale of screenshots")
+	screenshotFlag      = flag.Bool("screenshot", false, "With -headless, save a screenshot of the last frame")
+	recordVideoFlag     = flag.String("record-video", "", "Record video of every frame from the start to an AVI file, with a silent audio track until there is an APU")
+	gifSecondsFlag      = flag.Int("gif-seconds", 5, "Number of seconds saved as an animated GIF with F10, 0 to disable")
+	rewindFlag          = flag.Int("rewind", 10, "Number of seconds that can be rewound with Backspace, 0 to disable rewind")
 )
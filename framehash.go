@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// FrameHash identifies the emulator output after a frame. Video is hashed from
+// the 9-bit NES colors rather than RGBA, so that it doesn't depend on the
+// palette or filter.
+type FrameHash struct {
+	Frame uint64 // Number of frames completed
+	Video uint32 // CRC32 of the frame
+	RAM   uint32 // CRC32 of CPU RAM and PRG RAM
+}
+
+func (h FrameHash) String() string {
+	return fmt.Sprintf("%d %08x %08x", h.Frame, h.Video, h.RAM)
+}
+
+// FrameHash hashes the last finished frame and the current RAM.
+func (g *Game) FrameHash() FrameHash {
+	var pixels [len(g.pixels) * 2]byte
+	for i, c := range g.pixels {
+		binary.LittleEndian.PutUint16(pixels[i*2:], c)
+	}
+	ram := crc32.NewIEEE()
+	ram.Write(g.ram[:])
+	ram.Write(g.prgram)
+	return FrameHash{
+		Frame: g.frame,
+		Video: crc32.ChecksumIEEE(pixels[:]),
+		RAM:   ram.Sum32(),
+	}
+}
+
+// ReadFrameHashes reads frame hashes in the format written by FrameHash.String,
+// one per line.
+func ReadFrameHashes(r io.Reader) ([]FrameHash, error) {
+	var hashes []FrameHash
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" {
+			continue
+		}
+		var h FrameHash
+		if _, err := fmt.Sscanf(s, "%d %x %x", &h.Frame, &h.Video, &h.RAM); err != nil {
+			return nil, fmt.Errorf("line %d: bad frame hash %q: %w", line, s, err)
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, sc.Err()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFrameHashRoundTrip(t *testing.T) {
+	hashes := []FrameHash{
+		{Frame: 1, Video: 0xdeadbeef, RAM: 0},
+		{Frame: 2, Video: 0, RAM: 0xffffffff},
+		{Frame: 1 << 40, Video: 0x01234567, RAM: 0x89abcdef},
+	}
+	var sb strings.Builder
+	for _, h := range hashes {
+		sb.WriteString(h.String() + "\n")
+	}
+	got, err := ReadFrameHashes(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, hashes) {
+		t.Errorf("ReadFrameHashes() = %v, want %v", got, hashes)
+	}
+}
+
+func TestReadFrameHashesBlankLines(t *testing.T) {
+	got, err := ReadFrameHashes(strings.NewReader("\n1 0000000a 0000000b\n  \n\n2 0000000c 0000000d\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FrameHash{{1, 10, 11}, {2, 12, 13}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadFrameHashes() = %v, want %v", got, want)
+	}
+}
+
+func TestReadFrameHashesErrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"garbage", "line 1: bad frame hash"},
+		{"1 0000000a 0000000b\n\n2 0000000c\n", "line 3: bad frame hash"},
+		{"1 0000000a 0000000b\nx 0000000c 0000000d\n", "line 2: bad frame hash"},
+		{"1 zz 0000000b\n", "line 1: bad frame hash"},
+	}
+	for _, tt := range tests {
+		_, err := ReadFrameHashes(strings.NewReader(tt.in))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ReadFrameHashes(%q) error = %v, want %q", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestFrameHashDeterministic(t *testing.T) {
+	run := func() []FrameHash {
+		g, err := NewGame(testROM(0, 1, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range g.ram {
+			g.ram[i] = byte(i * 7)
+		}
+		g.ppumask = 0x18
+		var hashes []FrameHash
+		for range 5 {
+			g.runFrame()
+			hashes = append(hashes, g.FrameHash())
+		}
+		return hashes
+	}
+	a, b := run(), run()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("two identical runs hashed differently: %v, %v", a, b)
+	}
+}
+
+func TestFrameHashPixel(t *testing.T) {
+	g := testGame(t)
+	g.runFrame()
+	before := g.FrameHash()
+	g.pixels[256*120+128] ^= 1
+	after := g.FrameHash()
+	if after.Video == before.Video {
+		t.Error("changing a pixel didn't change the video hash")
+	}
+	if after.RAM != before.RAM || after.Frame != before.Frame {
+		t.Errorf("changing a pixel changed more than the video hash: %v, %v", before, after)
+	}
+}
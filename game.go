@@ -2,8 +2,16 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"image"
 	"log/slog"
+	"math"
+	"path/filepath"
+	"time"
 
+	"github.com/MatusOllah/smolnes-go/ines"
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/inpututil"
 	input "github.com/quasilyte/ebitengine-input"
@@ -14,57 +22,136 @@ const (
 	Height = 600
 )
 
+var (
+	// ErrUnsupportedMapper is returned when the ROM uses a mapper that isn't implemented.
+	ErrUnsupportedMapper = errors.New("unsupported mapper")
+
+	// ErrUnsupportedROMSize is returned when the PRG/CHR ROM size can't be banked.
+	ErrUnsupportedROMSize = errors.New("unsupported ROM size")
+)
+
+// mapperLimits holds the largest PRG/CHR ROM, in bytes, whose bank numbers fit
+// in each supported mapper's bank registers.
+var mapperLimits = map[uint16]struct{ prg, chr int }{
+	0: {32 << 10, 8 << 10},
+	1: {256 << 10, 128 << 10},
+	2: {512 << 10, 8 << 10},
+	3: {32 << 10, 32 << 10},
+	4: {512 << 10, 256 << 10},
+	7: {256 << 10, 8 << 10},
+}
+
 type Game struct {
-	rom, chrrom                  []byte     // Points to the start of PRG/CHR ROM
-	prg                          [4]byte    // Current PRG/CHR banks
-	chr                          [8]byte    //
-	prgbits, chrbits             byte       // Number of bits per PRG/CHR bank
-	a, x, y, p, s, pch, pcl      byte       // CPU registers
-	addrLo, addrHi               byte       // Current instruction address
-	nomem                        byte       // 1 => current instruction doesn't write to memory
-	result                       byte       // Temp variable
-	val                          byte       // Current instruction value
-	cross                        byte       // 1 => page crossing occurred
-	tmp                          byte       // Temp variables
-	ppumask, ppuctrl, ppustatus  byte       // PPU registers
-	ppubuf                       byte       // PPU buffered reads
-	w                            bool       // Write toggle PPU register
-	fineX                        byte       // X fine scroll offset, 0..7
-	opcode                       byte       // Current instruction opcode
-	nmiIRQ                       byte       // IRQ/NMI flag
-	ntb                          byte       // Nametable byte
-	ptbLo                        byte       // Pattern table lowbyte
-	vram                         [2048]byte // Nametable RAM
-	paletteram                   [64]byte   // Palette RAM
-	ram                          [8192]byte // CPU RAM
-	chrram                       [8192]byte // CHR RAM (only used for some games)
-	prgram                       [8192]byte // PRG RAM (only used for some games)
-	oam                          [256]byte  // Object Attribute Memory (sprite RAM)
-	mask                         [20]byte   // Masks used in branch instructions
-	keys                         byte       // Joypad shift register
-	mirror                       byte       // Current mirroring mode
-	mmc1Bits, mmc1Data, mmc1Ctrl byte       // Mapper 1 (MMC1) registers
-	mmc3Chrprg                   [8]byte    // Mapper 3 (MMC3) registers
-	mmc3Bits, mmc3Irq, mmc3Latch byte       //
-	chrbank0, chrbank1, prgbank  byte       // Current PRG/CHR bank
-	rombuf                       []byte     // Buffer to read ROM file into
-
-	scany            uint16 // Scanline Y
-	t, v             uint16 // "Loopy" PPU registers
-	sum              uint16 // Sum used for ADC/SB
-	dot              uint16 // Horizontal position of PPU, from 0..340
-	atb              uint16 // Attribute byte
-	shiftHi, shiftLo uint16 // Pattern table shift registers
-	cycles           uint16 // Cycle count for current instruction
-	//frameBuffer      [61440]uint16 // 256x240 pixel frame buffer. Top and bottom 8 rows are not drawn.
-	frameBuffer []byte // 256x240 RGBA pixel frame buffer. Top and bottom 8 rows are not drawn.
+	rom, chrrom                  []byte         // Points to the start of PRG/CHR ROM (chrrom points to chrram for CHR RAM games)
+	chrWritable                  bool           // true if chrrom is CHR RAM
+	prg                          [4]byte        // Current PRG/CHR banks
+	chr                          [8]byte        //
+	prgbits, chrbits             byte           // Number of bits per PRG/CHR bank
+	a, x, y, p, s, pch, pcl      byte           // CPU registers
+	addrLo, addrHi               byte           // Current instruction address
+	nomem                        byte           // 1 => current instruction doesn't write to memory
+	result                       byte           // Temp variable
+	val                          byte           // Current instruction value
+	cross                        byte           // 1 => page crossing occurred
+	tmp                          byte           // Temp variables
+	ppumask, ppuctrl, ppustatus  byte           // PPU registers
+	ppubuf                       byte           // PPU buffered reads
+	ppuOpenBus                   byte           // PPU I/O bus latch, read back from write-only registers
+	w                            bool           // Write toggle PPU register
+	fineX                        byte           // X fine scroll offset, 0..7
+	opcode                       byte           // Current instruction opcode
+	nmiIRQ                       byte           // IRQ/NMI flag
+	ntb                          byte           // Nametable byte
+	ptbLo                        byte           // Pattern table lowbyte
+	vram                         [4096]byte     // Nametable RAM (2k internal + 2k for four-screen cartridges)
+	nametables                   [4][]byte      // 1k nametables mapped at $2000, $2400, $2800 and $2C00
+	paletteram                   [32]byte       // Palette RAM
+	ram                          [8192]byte     // CPU RAM
+	chrram                       []byte         // CHR RAM (only used for some games)
+	prgram                       []byte         // PRG RAM (only used for some games), battery-backed part first
+	oam                          [256]byte      // Object Attribute Memory (sprite RAM)
+	oamaddr                      byte           // OAM address
+	mask                         [20]byte       // Masks used in branch instructions
+	keys                         [2]byte        // Joypad 1 and 2 shift registers
+	mirror                       ines.Mirroring // Current mirroring mode
+	mmc1Bits, mmc1Data, mmc1Ctrl byte           // Mapper 1 (MMC1) registers
+	mmc3Chrprg                   [8]byte        // Mapper 3 (MMC3) registers
+	mmc3Bits, mmc3Irq, mmc3Latch byte           //
+	chrbank0, chrbank1, prgbank  byte           // Current PRG/CHR bank
+	cart                         *ines.Cartridge
+	region                       *Region // Timing of the emulated console
+	dotsFrac                     int     // PPU dots owed to the PPU, in 1/CPUPerDots units
+	prgBanks                     int     // Number of 16k PRG banks
+
+	sramPath     string    // Path to the .sav file, empty if the cartridge has no battery
+	sramSize     int       // Size of the battery-backed part of PRG RAM
+	sramDirty    bool      // true if battery-backed PRG RAM changed since the last flush
+	sramLastSave time.Time // Time of the last flush
+
+	romHash     [sha1.Size]byte       // SHA-1 of PRG and CHR ROM, identifies the game in save states
+	statePath   func(slot int) string // Returns the path of a save state slot, nil if save states are disabled
+	stateSlot   int                   // Current save state slot, 0..9
+	rewind      *rewindBuffer         // Recent frames to rewind through, nil if rewind is disabled
+	rewindState []byte                // Scratch buffer for the state pushed to rewind every frame
+	loadScratch *Game                 // Console that LoadState decodes into first, allocated on first use
+
+	romName         string     // ROM file name without extension, used to name screenshots
+	screenshotDir   string     // Directory for screenshots
+	screenshotScale int        // Integer scale of screenshots
+	video           *aviWriter // Video being recorded, nil if not recording
+	gif             *gifBuffer // Recent frames for GIF capture, nil if GIF capture is disabled
+
+	paused          bool    // true if emulation is paused, frames only run with frame advance
+	slowMotion      bool    // true if slow motion is toggled on
+	slowMotionSpeed float64 // Speed in slow motion, between 0 and 1
+	fastForward     float64 // Speed while fast-forwarding, 0 for uncapped
+	speedAcc        float64 // Frames owed to the current speed, carried over between ticks
+
+	pads           [2]byte // Controller state latched for the current frame, bit i set if nesBtns[i] is pressed
+	command        byte    // Movie commands (CommandReset, CommandPower) to run before the next frame
+	movie          *Movie  // Movie being recorded or played back, nil if none
+	movieRecording bool    // true if recording into movie, false if playing it back
+
+	scany            uint16        // Scanline Y
+	t, v             uint16        // "Loopy" PPU registers
+	sum              uint16        // Sum used for ADC/SB
+	dot              uint16        // Horizontal position of PPU, from 0..340
+	atb              uint16        // Attribute byte
+	shiftHi, shiftLo uint16        // Pattern table shift registers
+	cycles           uint16        // Cycle count for current instruction
+	pixels           [61440]uint16 // 256x240 pixel frame buffer of 9-bit NES colors (emphasis + color index).
+
+	frameBuffer []byte        // 256x240 RGBA pixel frame buffer, converted from pixels once per frame.
+	frameImage  *ebiten.Image // frameBuffer uploaded for drawing
+	frameDone   bool          // true once the PPU has finished the current frame
+	overscan    Overscan      // Pixels cropped from each edge when presenting the frame
+	palette     *Palette      // Palette used to convert pixels to RGBA
+
+	palettes     []namedPalette // Palettes to cycle through
+	paletteIndex int            // Index of the current palette in palettes
+
+	ntsc       *ntscFilter   // NTSC filter, created when first enabled
+	ntscPreset int           // Index into ntscPresets, -1 if the NTSC filter is off
+	ntscImage  *ebiten.Image // NTSC filter output uploaded for drawing
+	frame      uint64        // Number of frames completed
 
 	shiftAt int
 
-	inputSystem  input.System
-	inputHandler *input.Handler
+	oddFrame    bool // true on odd frames, which are one dot shorter when rendering
+	vblSuppress bool // true if a $2002 read keeps vblank from being set this frame
+
+	spriteCount                                   int      // Number of sprites on the current scanline
+	spriteX, spriteAttr, spritePatLo, spritePatHi [64]byte // Sprites on the current scanline (secondary OAM)
+	sprite0Line                                   bool     // true if sprite 0 is on the current scanline
+	noSpriteLimit                                 bool     // true to draw more than 8 sprites per scanline
+
+	inputSystem   input.System
+	inputHandlers [2]*input.Handler // Controller 1 and 2, as input players 0 and 1
 }
 
+// MMC1 control register mirroring modes.
+var mmc1Mirroring = [4]ines.Mirroring{ines.SingleScreenA, ines.SingleScreenB, ines.Vertical, ines.Horizontal}
+
 func bool2byte(b bool) byte {
 	if b {
 		return 1
@@ -74,19 +161,49 @@ func bool2byte(b bool) byte {
 }
 
 func (g *Game) getCHRByte(a uint16) *byte {
-	return &g.chrrom[uint16(g.chr[a>>uint16(g.chrbits)])<<g.chrbits|a%(1<<g.chrbits)]
+	i := int(g.chr[a>>g.chrbits])<<g.chrbits | int(a)&(1<<g.chrbits-1)
+	return &g.chrrom[i%len(g.chrrom)]
+}
+
+// paletteAddr returns the index into palette RAM for PPU address a. $3F10,
+// $3F14, $3F18 and $3F1C mirror $3F00, $3F04, $3F08 and $3F0C.
+func paletteAddr(a uint16) uint16 {
+	a &= 0x1f
+	if a&0x13 == 0x10 {
+		a ^= 0x10
+	}
+	return a
 }
 
 func (g *Game) getNametableByte(a uint16) *byte {
-	switch g.mirror {
-	case 0:
-		return &g.vram[a%1024]
-	case 1:
-		return &g.vram[a%1024+1024]
-	case 2:
-		return &g.vram[a&2047]
-	default:
-		return &g.vram[a/2&1024|a%1024]
+	return &g.nametables[a>>10&3][a&1023]
+}
+
+// setMirroring points the nametables at VRAM according to the mirroring mode.
+// Mappers that supply their own nametable memory (e.g. MMC5, Namco 163) can
+// set g.nametables directly afterwards.
+func (g *Game) setMirroring(m ines.Mirroring) {
+	// Cartridges with four-screen VRAM ignore the mapper's mirroring control.
+	if g.cart.Mirroring == ines.FourScreen {
+		m = ines.FourScreen
+	}
+	g.mirror = m
+
+	var pages [4]int
+	switch m {
+	case ines.Horizontal:
+		pages = [4]int{0, 0, 1, 1}
+	case ines.Vertical:
+		pages = [4]int{0, 1, 0, 1}
+	case ines.FourScreen:
+		pages = [4]int{0, 1, 2, 3}
+	case ines.SingleScreenA:
+		pages = [4]int{0, 0, 0, 0}
+	case ines.SingleScreenB:
+		pages = [4]int{1, 1, 1, 1}
+	}
+	for i, p := range pages {
+		g.nametables[i] = g.vram[p*1024 : (p+1)*1024]
 	}
 }
 
@@ -107,13 +224,18 @@ func (g *Game) mem(lo, hi, val byte, write bool) byte {
 	case 2, 3: // $2000..$2007 PPU (mirrored)
 		lo &= 7
 
+		// Writes to any PPU register fill the open bus latch.
+		if write {
+			g.ppuOpenBus = val
+		}
+
 		// read/write $2007
 		if lo == 7 {
 			g.tmp = g.ppubuf
 			var rom *uint8
 			if g.v < 8192 {
 				// CHR ROM / RAM
-				if write && !bytes.Equal(g.chrrom, g.chrram[:]) {
+				if write && !g.chrWritable {
 					rom = &g.tmp
 				} else {
 					rom = g.getCHRByte(g.v)
@@ -122,34 +244,57 @@ func (g *Game) mem(lo, hi, val byte, write bool) byte {
 				// Nametable RAM
 				rom = g.getNametableByte(g.v)
 			} else {
-				// Palette RAM with mirroring
-				addr := g.v
-				if (g.v & 0x13) == 0x10 {
-					addr = g.v ^ 0x10
-				}
-				rom = &g.paletteram[addr]
+				rom = &g.paletteram[paletteAddr(g.v)]
 			}
 			if write {
 				*rom = val
+			} else if g.v >= 16128 {
+				// Palette reads aren't buffered. The upper 2 bits come from the
+				// open bus latch, and the buffer is filled with the nametable
+				// byte "underneath" the palette.
+				g.tmp = *rom&0x3f | g.ppuOpenBus&0xc0
+				if g.ppumask&1 != 0 {
+					g.tmp &= 0xf0
+				}
+				g.ppubuf = *g.getNametableByte(g.v)
 			} else {
 				g.ppubuf = *rom
 			}
-			if g.ppuctrl&4 != 0 {
+
+			// During rendering, the PPU's own increments are triggered instead
+			// of the normal one.
+			if g.ppumask&24 != 0 && (g.scany < 240 || g.scany == g.region.preRenderLine()) {
+				g.incrementX()
+				g.incrementY()
+			} else if g.ppuctrl&4 != 0 {
 				g.v += 32
 			} else {
 				g.v++
 			}
 			g.v %= 16384
+
+			if !write {
+				g.ppuOpenBus = g.tmp
+			}
 			return g.tmp
 		}
 
 		if write {
 			switch lo {
 			case 0: // $2000 ppuctrl
+				// Enabling NMI during vblank triggers it immediately.
+				if g.ppuctrl&128 == 0 && val&128 != 0 && g.ppustatus&128 != 0 {
+					g.nmiIRQ = 4
+				}
 				g.ppuctrl = val
 				g.t = g.t&0xf3ff | uint16(val)%4<<10
 			case 1: // $2001 ppumask
 				g.ppumask = val
+			case 3: // $2003 oamaddr
+				g.oamaddr = val
+			case 4: // $2004 oamdata
+				g.oam[g.oamaddr] = val
+				g.oamaddr++
 			case 5: // $2005 ppuscroll
 				g.w = !g.w
 				if g.w {
@@ -166,54 +311,74 @@ func (g *Game) mem(lo, hi, val byte, write bool) byte {
 					g.v = g.t&^uint16(0xff) | uint16(val)
 				}
 			}
-
-			if lo == 2 { // $2002 ppustatus
-				g.tmp = g.ppustatus & 0xe0
+		} else {
+			switch lo {
+			case 2: // $2002 ppustatus
+				if g.scany == g.region.VBlankLine {
+					switch g.dot {
+					case 1:
+						// Reading one dot before vblank starts reads it as
+						// clear and keeps it from being set this frame.
+						g.vblSuppress = true
+					case 2, 3:
+						// Reading right as vblank starts reads it as set, but
+						// suppresses the NMI.
+						g.nmiIRQ &^= 4
+					}
+				}
+				// The lower 5 bits are open bus.
+				g.ppuOpenBus = g.ppustatus&0xe0 | g.ppuOpenBus&0x1f
 				g.ppustatus &= 0x7f
 				g.w = false
-				return g.tmp
+			case 4: // $2004 oamdata
+				g.ppuOpenBus = g.oam[g.oamaddr]
 			}
+			// Write-only registers read back the open bus latch.
+			return g.ppuOpenBus
 		}
 	case 4:
 		//TODO: APU
 		if write && lo == 20 { // $4014 OAM DMA
-			for i := uint16(256); i > 0; i-- {
-				g.oam[i] = g.mem(byte(i), val, 0, false)
-			}
-		}
-		// $4016 Joypad 1
-		g.tmp = 0
-		for i := 7; i >= 0; i-- {
-			g.tmp <<= 1
-			if g.inputHandler.ActionIsPressed(nesBtns[i]) {
-				g.tmp |= 1
+			for i := range 256 {
+				g.oam[g.oamaddr+byte(i)] = g.mem(byte(i), val, 0, false)
 			}
-
 		}
-		if lo == 22 {
-			if write {
-				g.keys = g.tmp
-			} else {
-				g.tmp = g.keys & 1
-				g.keys = (g.keys >> 1) | 0x80
-				return g.tmp
-			}
+		// Writing $4016 latches both joypads. Reading $4016 (joypad 1) or
+		// $4017 (joypad 2) shifts out the next button.
+		if write && lo == 22 {
+			g.keys = g.pads
+		} else if !write && (lo == 22 || lo == 23) {
+			k := &g.keys[lo-22]
+			g.tmp = *k & 1
+			*k = (*k >> 1) | 0x80
+			return g.tmp
 		}
 		return 0
+	case 5: // $5000...$5fff expansion area, unused by the supported mappers
 	case 6, (6 + 1): // $6000...$7fff PRG RAM
-		addr &= 8191
+		if len(g.prgram) == 0 {
+			break
+		}
+		i := int(addr&8191) % len(g.prgram)
 		if write {
-			g.prgram[addr] = val
+			if i < g.sramSize && g.prgram[i] != val {
+				g.sramDirty = true
+			}
+			g.prgram[i] = val
 			return val
 		} else {
-			return g.prgram[addr]
+			return g.prgram[i]
 		}
 	default: // $8000...$ffff ROM
 		// handle mapper writes
 		if write {
-			switch g.rombuf[6] >> 4 {
+			switch g.cart.Mapper {
 			case 7: // mapper 7
-				g.mirror = bool2byte(val/16 == 0)
+				if val&16 != 0 {
+					g.setMirroring(ines.SingleScreenB)
+				} else {
+					g.setMirroring(ines.SingleScreenA)
+				}
 				g.prg[0] = val % 8 * 2
 				g.prg[1] = g.prg[0] + 1
 			case 4: // mapper 4
@@ -221,23 +386,27 @@ func (g *Game) mem(lo, hi, val byte, write bool) byte {
 				switch hi >> 1 {
 				case 4: // Bank select/bank data
 					if addr1 != 0 {
-						g.mmc3Chrprg[g.mmc1Bits&7] = val
+						g.mmc3Chrprg[g.mmc3Bits&7] = val
 					} else {
 						g.mmc3Bits = val
 					}
 					g.tmp = g.mmc3Bits >> 5 & 4
-					for i := byte(4); i > 0; i-- {
+					for i := range byte(4) {
 						g.chr[0+i+g.tmp] = g.mmc3Chrprg[i/2] & ^bool2byte(i%2 == 0) | i%2
 						g.chr[4+i-g.tmp] = g.mmc3Chrprg[2+i]
 					}
-					g.tmp = g.mmc1Bits >> 5 & 2
+					g.tmp = g.mmc3Bits >> 5 & 2
 					g.prg[0+g.tmp] = g.mmc3Chrprg[6]
 					g.prg[1] = g.mmc3Chrprg[7]
-					g.prg[3] = g.rombuf[4]*2 - 1
+					g.prg[3] = byte(g.prgBanks*2 - 1)
 					g.prg[2-g.tmp] = g.prg[3] - 1
 				case 5: // Mirroring
 					if addr1 == 0 {
-						g.mirror = 2 + val%2
+						if val&1 != 0 {
+							g.setMirroring(ines.Horizontal)
+						} else {
+							g.setMirroring(ines.Vertical)
+						}
 					}
 				case 6: // IRQ Latch
 					if addr1 == 0 {
@@ -261,7 +430,7 @@ func (g *Game) mem(lo, hi, val byte, write bool) byte {
 					g.tmp = byte(addr >> 13)
 					switch g.tmp {
 					case 4:
-						g.mirror = g.mmc1Data & 3
+						g.setMirroring(mmc1Mirroring[g.mmc1Data&3])
 						g.mmc1Ctrl = g.mmc1Data
 					case 5:
 						g.chrbank0 = g.mmc1Data
@@ -287,7 +456,7 @@ func (g *Game) mem(lo, hi, val byte, write bool) byte {
 					} else {
 						if g.tmp == 1 {
 							g.prg[0] = g.prgbank
-							g.prg[1] = g.rombuf[4] - 1
+							g.prg[1] = byte(g.prgBanks - 1)
 						} else {
 							g.prg[0] = g.prgbank & 0xfe
 							g.prg[1] = g.prgbank | 1
@@ -296,7 +465,8 @@ func (g *Game) mem(lo, hi, val byte, write bool) byte {
 				}
 			}
 		}
-		return g.rom[(g.prg[hi-8>>g.prgbits-12]&(g.rombuf[4]<<(14-g.prgbits))-1)<<g.prgbits|byte(addr)&(1<<g.prgbits)-1]
+		bank := int(g.prg[(hi-8)>>(g.prgbits-12)]) & (g.prgBanks<<(14-g.prgbits) - 1)
+		return g.rom[bank<<g.prgbits|int(addr)&(1<<g.prgbits-1)]
 	}
 	return 0xff
 }
@@ -318,35 +488,104 @@ func (g *Game) setNZ(val byte) byte {
 }
 
 func NewGame(rom []byte) (*Game, error) {
+	cart, err := ines.Parse(rom)
+	if err != nil {
+		return nil, err
+	}
+	limits, ok := mapperLimits[cart.Mapper]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedMapper, cart.Mapper)
+	}
+	if len(cart.PRGROM)%16384 != 0 {
+		return nil, fmt.Errorf("%w: PRG ROM is %d bytes, not a multiple of 16k", ErrUnsupportedROMSize, len(cart.PRGROM))
+	}
+	if n := len(cart.PRGROM) >> 14; n&(n-1) != 0 {
+		return nil, fmt.Errorf("%w: PRG ROM has %d banks, not a power of two", ErrUnsupportedROMSize, n)
+	}
+	if len(cart.PRGROM) > limits.prg {
+		return nil, fmt.Errorf("%w: PRG ROM is %dk, mapper %d supports up to %dk", ErrUnsupportedROMSize, len(cart.PRGROM)>>10, cart.Mapper, limits.prg>>10)
+	}
+	if len(cart.CHRROM)%8192 != 0 {
+		return nil, fmt.Errorf("%w: CHR ROM is %d bytes, not a multiple of 8k", ErrUnsupportedROMSize, len(cart.CHRROM))
+	}
+	if len(cart.CHRROM) > limits.chr {
+		return nil, fmt.Errorf("%w: CHR ROM is %dk, mapper %d supports up to %dk", ErrUnsupportedROMSize, len(cart.CHRROM)>>10, cart.Mapper, limits.chr>>10)
+	}
+	slog.Debug("parsed ROM header",
+		"nes20", cart.NES20,
+		"mapper", cart.Mapper,
+		"submapper", cart.Submapper,
+		"prgrom", len(cart.PRGROM),
+		"chrrom", len(cart.CHRROM),
+		"mirroring", cart.Mirroring,
+		"battery", cart.Battery,
+		"timing", cart.Timing,
+		"console", cart.ConsoleType,
+	)
+
+	g := newGame(cart)
+	g.inputSystem.Init(input.SystemConfig{DevicesEnabled: input.KeyboardDevice | input.GamepadDevice})
+	g.SetKeymap(0, keymap)
+	g.SetKeymap(1, keymap2)
+	return g, nil
+}
+
+// SetKeymap replaces the key bindings of controller 1 (player 0) or 2 (player
+// 1). Each player uses the gamepad with the same index.
+func (g *Game) SetKeymap(player int, km input.Keymap) {
+	g.inputHandlers[player] = g.inputSystem.NewHandler(uint8(player), km)
+}
+
+// newGame returns a console with cart inserted, in its power-on state.
+func newGame(cart *ines.Cartridge) *Game {
 	g := &Game{}
 	g.frameBuffer = make([]byte, 245760)
-	g.inputSystem.Init(input.SystemConfig{DevicesEnabled: input.KeyboardDevice | input.GamepadDevice})
-	g.inputHandler = g.inputSystem.NewHandler(0, keymap)
+	g.overscan = Overscan{Top: 8, Bottom: 8}
+	g.setPalettes(builtinPalettes)
+	g.ntscPreset = -1
 	g.prgbits = 14
 	g.chrbits = 12
 	g.p = 4
 	g.s = 0xfd
 	g.mask = [20]byte{128, 64, 1, 2, 1, 0, 0, 1, 4, 0, 0, 4, 0, 0, 64, 0, 8, 0, 0, 8}
-	g.rombuf = rom
-	g.rom = rom[16:] // skip iNES header
-	// PRG1 is the last bank. `rombuf[4]` is the number of 16k PRG banks.
-	g.prg[1] = g.rombuf[4] - 1
-	// CHR0 ROM is after all PRG data in the file. `rombuf[5]` is the number of
-	// 8k CHR banks. If it is zero, assume the game uses CHR RAM.
-	if g.rombuf[5] != 0 {
-		g.chrrom = g.rom[int(g.rombuf[4])<<14:]
-	} else {
-		copy(g.chrrom, g.chrram[:])
-	}
-	// CHR1 is the last 4k bank.
-	if g.rombuf[5] != 0 {
-		g.chr[1] = g.rombuf[5]*2 - 1
+	g.cart = cart
+	g.region = regionForTiming(cart.Timing)
+	g.slowMotionSpeed = 0.5
+	g.fastForward = 4
+	g.romName = "smolnes"
+	g.screenshotDir = "."
+	g.screenshotScale = 1
+	g.rom = cart.PRGROM
+	h := sha1.New()
+	h.Write(cart.PRGROM)
+	h.Write(cart.CHRROM)
+	h.Sum(g.romHash[:0])
+	g.prgBanks = len(cart.PRGROM) >> 14
+	// PRG1 is the last bank.
+	g.prg[1] = byte(g.prgBanks - 1)
+	// If there is no CHR ROM, the game uses CHR RAM. Its size comes from the
+	// NES 2.0 header; iNES headers always mean 8k.
+	if len(cart.CHRROM) != 0 {
+		g.chrrom = cart.CHRROM
+		// CHR1 is the last 4k bank.
+		g.chr[1] = byte(len(cart.CHRROM)>>12 - 1)
 	} else {
+		size := cart.CHRRAMSize + cart.CHRNVRAMSize
+		if size == 0 {
+			size = 8192
+		}
+		g.chrram = make([]byte, size)
+		g.chrrom = g.chrram
+		g.chrWritable = true
 		g.chr[1] = 1
 	}
-	// Bit 0 of `rombuf[6]` is 0=>horizontal mirroring, 1=>vertical mirroring.
-	g.mirror = 3 - g.rombuf[6]&1
-	if g.rombuf[6]/16 == 4 {
+	// Battery-backed PRG RAM comes first so that it is what gets mapped at
+	// $6000 on boards with only one chip.
+	g.sramSize = cart.PRGNVRAMSize
+	g.prgram = make([]byte, cart.PRGNVRAMSize+cart.PRGRAMSize)
+	g.loadTrainer()
+	g.setMirroring(cart.Mirroring)
+	if cart.Mapper == 4 {
 		g.mem(0, 128, 0, true) // Update to default mmc3 banks
 		g.prgbits--            // 8kb PRG banks
 		g.chrbits -= 2         // 1kb CHR banks
@@ -356,12 +595,50 @@ func NewGame(rom []byte) (*Game, error) {
 	g.pcl = g.mem(0xfc, 0xff, 0, false)
 	g.pch = g.mem(0xfe, 0xff, 0, false)
 
-	return g, nil
+	return g
+}
+
+// loadTrainer copies the cartridge's trainer, if any, to $7000 in PRG RAM.
+func (g *Game) loadTrainer() {
+	if len(g.cart.Trainer) != 0 && len(g.prgram) >= 0x1000+len(g.cart.Trainer) {
+		copy(g.prgram[0x1000:], g.cart.Trainer)
+	}
+}
+
+// reset presses the reset button. The CPU jumps through the reset vector with
+// interrupts disabled, and the PPU stops rendering until the game turns it back
+// on. Everything else, including RAM and mapper registers, is kept.
+func (g *Game) reset() {
+	g.s -= 3
+	g.p |= 4
+	g.ppuctrl = 0
+	g.ppumask = 0
+	g.ppubuf = 0
+	g.w = false
+	g.pcl = g.mem(0xfc, 0xff, 0, false)
+	g.pch = g.mem(0xfe, 0xff, 0, false)
+}
+
+// powerCycle turns the console off and on again. Battery-backed PRG RAM
+// survives, and the frame count keeps going so that movies stay in sync.
+func (g *Game) powerCycle() {
+	frame := g.frame
+	sram := bytes.Clone(g.prgram[:g.sramSize])
+	off := newGame(g.cart)
+	off.region = g.region
+	if err := g.LoadState(off.SaveState()); err != nil {
+		// Can't happen, the state is for the same ROM and region.
+		panic(err)
+	}
+	copy(g.prgram, sram)
+	g.frame = frame
 }
 
 func (g *Game) InitEbiten() {
 	ebiten.SetWindowSize(Width, Height)
 	ebiten.SetWindowTitle("smolnes-go")
+	// runFrames makes up the difference to the exact frame rate.
+	ebiten.SetTPS(int(math.Round(g.region.FrameRate)))
 }
 
 func (g *Game) Start() error {
@@ -372,9 +649,130 @@ func (g *Game) Update() error {
 	if inpututil.IsKeyJustPressed(ebiten.KeyF11) {
 		ebiten.SetFullscreen(!ebiten.IsFullscreen())
 	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyF2) {
+		g.cyclePalette()
+		slog.Info("switched palette", "palette", g.palettes[g.paletteIndex].name)
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyF3) {
+		g.cycleNTSCPreset()
+		if g.ntscPreset >= 0 {
+			slog.Info("switched NTSC filter", "preset", ntscPresets[g.ntscPreset].Name)
+		} else {
+			slog.Info("switched NTSC filter", "preset", "off")
+		}
+	}
+
+	if inpututil.IsKeyJustPressed(ebiten.KeyF6) {
+		g.stateSlot = (g.stateSlot + 9) % 10
+		slog.Info("selected save state slot", "slot", g.stateSlot)
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyF7) {
+		g.stateSlot = (g.stateSlot + 1) % 10
+		slog.Info("selected save state slot", "slot", g.stateSlot)
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyF5) {
+		if err := g.SaveStateSlot(g.stateSlot); err != nil {
+			slog.Error("failed to save state", "slot", g.stateSlot, "error", err)
+		} else {
+			slog.Info("saved state", "slot", g.stateSlot)
+		}
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyF8) {
+		if err := g.LoadStateSlot(g.stateSlot); err != nil {
+			slog.Error("failed to load state", "slot", g.stateSlot, "error", err)
+		} else {
+			slog.Info("loaded state", "slot", g.stateSlot)
+		}
+	}
+
+	if inpututil.IsKeyJustPressed(ebiten.KeyF12) {
+		if path, err := g.SaveScreenshot(g.screenshotDir, g.screenshotScale); err != nil {
+			slog.Error("failed to save screenshot", "error", err)
+		} else {
+			slog.Info("saved screenshot", "path", path)
+		}
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyF9) {
+		if g.video == nil {
+			path := filepath.Join(g.screenshotDir, fmt.Sprintf("%s-%s.avi", g.romName, time.Now().Format("20060102-150405")))
+			if err := g.StartVideo(path); err != nil {
+				slog.Error("failed to start video recording", "error", err)
+			} else {
+				slog.Info("started video recording", "path", path)
+			}
+		} else {
+			if err := g.StopVideo(); err != nil {
+				slog.Error("failed to finish video", "error", err)
+			} else {
+				slog.Info("stopped video recording")
+			}
+		}
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyF10) && g.gif != nil {
+		path := filepath.Join(g.screenshotDir, fmt.Sprintf("%s-%s.gif", g.romName, time.Now().Format("20060102-150405")))
+		if g.gif.count == 0 {
+			slog.Info("no frames to save as a GIF yet")
+		} else if b, err := g.EncodeGIF(); err != nil {
+			slog.Error("failed to encode GIF", "error", err)
+		} else if err := writeFileAtomic(path, b); err != nil {
+			slog.Error("failed to save GIF", "path", path, "error", err)
+		} else {
+			slog.Info("saved GIF", "path", path)
+		}
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyF1) {
+		if ebiten.IsKeyPressed(ebiten.KeyShift) {
+			g.command |= CommandPower
+		} else {
+			g.command |= CommandReset
+		}
+	}
+	if inpututil.IsKeyJustPressed(keyPause) {
+		g.paused = !g.paused
+		slog.Info("paused", "paused", g.paused)
+	}
+	if inpututil.IsKeyJustPressed(keySlowMotion) {
+		g.slowMotion = !g.slowMotion
+		slog.Info("slow motion", "enabled", g.slowMotion, "speed", g.slowMotionSpeed)
+	}
 
 	g.inputSystem.Update()
 
+	if g.sramDirty && time.Since(g.sramLastSave) >= sramFlushInterval {
+		if err := g.SaveSRAM(); err != nil {
+			slog.Error("failed to save battery-backed RAM", "path", g.sramPath, "error", err)
+		}
+	}
+
+	// Holding Backspace plays the last frames backward instead of running.
+	if g.rewind != nil && ebiten.IsKeyPressed(ebiten.KeyBackspace) {
+		state, err := g.rewind.pop()
+		if err != nil {
+			slog.Error("failed to rewind, dropping rewind buffer", "error", err)
+			g.rewind.reset()
+		} else if state != nil {
+			if err := g.LoadState(state); err != nil {
+				slog.Error("failed to rewind", "error", err)
+			}
+			g.renderFrame()
+		}
+		return nil
+	}
+
+	if g.paused {
+		if inpututil.IsKeyJustPressed(keyFrameAdvance) {
+			g.runFrame()
+		}
+		return nil
+	}
+
+	g.runFrames()
+
+	return nil
+}
+
+// step executes one CPU instruction and catches the PPU up with it.
+func (g *Game) step() {
 	g.cycles = 0
 	g.nomem = 0
 	if g.nmiIRQ != 0 {
@@ -400,79 +798,57 @@ func (g *Game) Update() error {
 		}
 	}
 
-	return nil
+	g.runPPU()
 }
 
-func (g *Game) Draw(screen *ebiten.Image) {
+// runPPU updates the PPU for the cycles taken by the current instruction.
+func (g *Game) runPPU() {
 	// Update PPU, which runs 3 times faster than CPU. Each CPU instruction
 	// takes at least 2 cycles.
-	for g.tmp = byte(g.cycles)*3 + 6; g.tmp > 0; g.tmp-- {
+	// PAL's 3.2 dots per cycle leave a fraction, which is carried over to the
+	// next instruction.
+	dots := (int(g.cycles)+2)*g.region.DotsPerCPU + g.dotsFrac
+	g.dotsFrac = dots % g.region.CPUPerDots
+	for n := dots / g.region.CPUPerDots; n > 0; n-- {
 		if g.ppumask&24 != 0 { // If background or sprites are enabled.
 			if g.scany < 240 {
 				if g.dot-256 > 63 { // dot [0..255,320..340]
 					// Draw a pixel to the framebuffer.
 					if g.dot < 256 {
 						// Read color and palette from shift registers.
-						color := byte(g.shiftHi>>14 - uint16(g.fineX)&2 | g.shiftLo>>15 - uint16(g.fineX)&1)
-						palette := byte(g.shiftAt>>28 - int(g.fineX)*2&12)
-
-						// If sprites are enabled.
-						if g.ppumask&16 != 0 {
-							// Loop through all sprites.
-							for sprite := 0; sprite < 256; sprite += 4 {
-								var spriteH uint16
-								if g.ppuctrl&32 != 0 {
-									spriteH = 16
-								} else {
-									spriteH = 8
-								}
-								spriteX := g.dot - uint16(g.oam[sprite+3])
-								spriteY := g.scany - uint16(g.oam[sprite]) - 1
-								sx := spriteX
-								if g.oam[sprite+2]&64 == 0 {
-									sx = spriteX ^ 7
-								}
-								sy := spriteY ^ (spriteH - 1)
-								if g.oam[sprite+2]&128 == 0 {
-									sy = spriteY
+						color := byte(g.shiftHi>>(14-uint16(g.fineX))&2 | g.shiftLo>>(15-uint16(g.fineX))&1)
+						palette := byte(g.shiftAt >> (28 - int(g.fineX)*2) & 12)
+
+						// Hide BG if it is disabled or clipped in the leftmost 8
+						// pixels.
+						if g.ppumask&8 == 0 || g.dot < 8 && g.ppumask&2 == 0 {
+							color = 0
+						}
+
+						// If sprites are enabled and not clipped.
+						if g.ppumask&16 != 0 && (g.dot >= 8 || g.ppumask&4 != 0) {
+							if spriteColor, spritePalette, behind, zero := g.spritePixel(); spriteColor != 0 {
+								// Maybe set sprite 0 hit flag. It never happens at
+								// x=255 or in the leftmost 8 pixels if either is
+								// clipped.
+								if zero && color != 0 && g.dot != 255 && (g.dot >= 8 || g.ppumask&6 == 6) {
+									g.ppustatus |= 64
 								}
-								if spriteX < 8 && spriteY < spriteH {
-									spriteTile := uint16(g.oam[sprite+1])
-									var spriteAddr uint16
-									if g.ppuctrl&32 != 0 {
-										// 8x16 sprites
-										spriteAddr = spriteTile%2<<12 | (spriteTile&65534)<<4 | (sy&8)*2 | sy&7
-									} else {
-										// 8x8 sprites
-										spriteAddr = (uint16(g.ppuctrl)&8)<<9 | spriteTile<<4 | sy&7
-									}
-									spriteColor := *g.getCHRByte(spriteAddr + 8)>>sx<<1&2 | *g.getCHRByte(spriteAddr)>>sx&1
-									// Only draw sprite if color is not 0 (transparent)
-									if spriteColor != 0 {
-										// Don't draw sprite if BG has priority.
-										if (g.oam[sprite+2] != 0) || (color != 0) {
-											color = spriteColor
-											palette = 16 | g.oam[sprite+2]*4&12
-										}
-										// Maybe set sprite0 hit flag.
-										if sprite == 0 && color != 0 {
-											g.ppustatus |= 64
-										}
-										break
-									}
+								// Don't draw sprite if BG has priority.
+								if !behind || color == 0 {
+									color = spriteColor
+									palette = spritePalette
 								}
 							}
 						}
 
-						// Write pixel to framebuffer. Always use palette 0 for color 0.
+						// Write pixel to framebuffer. Always use the backdrop color
+						// for color 0.
 						var colorIdx byte
 						if color != 0 {
 							colorIdx = palette | color
 						}
-						g.frameBuffer[g.scany*256+g.dot+0] = paletteNTSC[colorIdx][0]
-						g.frameBuffer[g.scany*256+g.dot+1] = paletteNTSC[colorIdx][1]
-						g.frameBuffer[g.scany*256+g.dot+2] = paletteNTSC[colorIdx][2]
-						g.frameBuffer[g.scany*256+g.dot+3] = paletteNTSC[colorIdx][3]
+						g.pixels[int(g.scany)*256+int(g.dot)] = g.ppuColor(uint16(colorIdx))
 					}
 
 					// Update shift registers every cycle.
@@ -487,80 +863,223 @@ func (g *Game) Draw(screen *ebiten.Image) {
 					case 1: // Read nametable byte.
 						g.ntb = *g.getNametableByte(g.v)
 					case 3: // Read attribute byte.
-						g.atb = (uint16(*g.getNametableByte(g.v&0xc00 | 0x3c0 | g.v>>4&0x38 | g.v/4&7)) >> (g.v>>5&2 | g.v/2&1) * 2) % 4 * 0x5555
+						g.atb = (uint16(*g.getNametableByte(g.v&0xc00 | 0x3c0 | g.v>>4&0x38 | g.v/4&7)) >> ((g.v>>5&2 | g.v/2&1) * 2)) % 4 * 0x5555
 					case 5: // Read pattern table low byte.
 						g.ptbLo = *g.getCHRByte(uint16(temp))
 					case 7: // Read pattern table high byte.
 						ptbHi := *g.getCHRByte(uint16(temp) | 8)
-						// Increment horizontal VRAM read address.
-						if g.v%32 == 31 {
-							g.v &= 65534 ^ 1024
-						} else {
-							g.v++
-						}
+						g.incrementX()
 						g.shiftHi |= uint16(ptbHi)
 						g.shiftLo |= uint16(g.ptbLo)
 						g.shiftAt |= int(g.atb)
 					}
 				}
 
-				// Increment vertical VRAM address
 				if g.dot == 256 {
-					if (g.v & (7 << 12)) != (7 << 12) {
-						g.v += 0x1000 // 4096 in hex
-					} else if (g.v & 0x3e0) == 928 {
-						g.v = (g.v & 0x8c1f) ^ 0x800
-					} else if (g.v & 0x3e0) == 0x3e0 {
-						g.v = g.v & 0x8c1f
-					} else {
-						g.v = (g.v & 0x8c1f) | ((g.v + 32) & 0x3e0)
-					}
+					g.incrementY()
 					// Reset horizontal VRAM address to T value
 					g.v = (g.v &^ 0x41f) | (g.t & 0x41f)
 				}
 			}
 
+			// Find the sprites on the next scanline. None are drawn on the
+			// first scanline.
+			if g.dot == 257 {
+				if g.scany < 240 {
+					g.evaluateSprites()
+				} else {
+					g.spriteCount = 0
+				}
+			}
+
 			// Check for MMC3 IRQ.
-			if (g.scany+1)%262 < 241 && g.dot == 261 && g.mmc3Irq != 0 && g.mmc3Latch == 0 {
+			if (g.scany < 240 || g.scany == g.region.preRenderLine()) && g.dot == 261 && g.mmc3Irq != 0 && g.mmc3Latch == 0 {
 				g.nmiIRQ = 1
 			}
 			g.mmc3Latch--
 
 			// Reset vertical VRAM address to T value.
-			if g.scany == 261 && g.dot > 279 && g.dot < 305 {
+			if g.scany == g.region.preRenderLine() && g.dot > 279 && g.dot < 305 {
 				g.v = g.v&0x841f | g.t&0x7be0
 			}
+		} else if g.scany < 240 && g.dot < 256 {
+			// With rendering disabled, the backdrop color is drawn, unless the
+			// VRAM address points into palette RAM.
+			var addr uint16
+			if g.v >= 0x3f00 {
+				addr = g.v
+			}
+			g.pixels[int(g.scany)*256+int(g.dot)] = g.ppuColor(addr)
 		}
 
 		if g.dot == 1 {
-			if g.scany == 241 {
-				// If NMI is enabled, trigger NMI.
-				if g.ppuctrl&128 != 0 {
-					g.nmiIRQ = 4
+			if g.scany == g.region.VBlankLine {
+				if !g.vblSuppress {
+					// If NMI is enabled, trigger NMI.
+					if g.ppuctrl&128 != 0 {
+						g.nmiIRQ = 4
+					}
+					g.ppustatus |= 128
 				}
-				g.ppustatus |= 128
-				// Render frame, skipping the top and bottom 8 pixels (they're often
-				// garbage).
-				screen.WritePixels(g.frameBuffer)
+				g.vblSuppress = false
+				g.renderFrame()
+				g.frameDone = true
+				g.frame++
 			}
 
-			// Clear ppustatus.
-			if g.scany == 261 {
+			// Clear vblank, sprite 0 hit and sprite overflow flags.
+			if g.scany == g.region.preRenderLine() {
 				g.ppustatus = 0
 			}
 		}
 
-		// Increment to next dot/scany. 341 dots per scanline, 262 scanlines per
-		// frame. Scanline 261 is represented as -1.
+		// Increment to next dot/scany. 341 dots per scanline, 262 (NTSC) or 312
+		// (PAL, Dendy) scanlines per frame. The last scanline is the pre-render
+		// scanline, also known as -1.
 		g.dot++
+		// On NTSC, odd frames with rendering enabled skip the last dot of the
+		// pre-render scanline.
+		if g.scany == g.region.preRenderLine() && g.dot == 340 && g.oddFrame && g.ppumask&24 != 0 && g.region.OddFrameDot {
+			g.dot = 341
+		}
 		if g.dot == 341 {
 			g.dot = 0
 			g.scany++
-			g.scany %= 262
+			g.scany %= g.region.Scanlines
+			if g.scany == 0 {
+				g.oddFrame = !g.oddFrame
+			}
 		}
 	}
 }
 
+// incrementX increments the coarse X scroll in the VRAM address, wrapping into
+// the horizontally adjacent nametable.
+func (g *Game) incrementX() {
+	if g.v%32 == 31 {
+		g.v = g.v&^31 ^ 1024
+	} else {
+		g.v++
+	}
+}
+
+// incrementY increments the fine Y scroll in the VRAM address, carrying into
+// coarse Y and the vertically adjacent nametable.
+func (g *Game) incrementY() {
+	if (g.v & (7 << 12)) != (7 << 12) {
+		g.v += 0x1000 // 4096 in hex
+	} else if (g.v & 0x3e0) == 928 {
+		g.v = (g.v & 0x8c1f) ^ 0x800
+	} else if (g.v & 0x3e0) == 0x3e0 {
+		g.v = g.v & 0x8c1f
+	} else {
+		g.v = (g.v & 0x8c1f) | ((g.v + 32) & 0x3e0)
+	}
+}
+
+// Overscan is the number of pixels cropped from each edge of the 256x240 frame.
+type Overscan struct {
+	Top, Bottom, Left, Right int
+}
+
+// Validate checks that the overscan leaves something to display.
+func (o Overscan) Validate() error {
+	if o.Top < 0 || o.Bottom < 0 || o.Left < 0 || o.Right < 0 {
+		return fmt.Errorf("invalid overscan %+v: must not be negative", o)
+	}
+	if o.Top+o.Bottom >= 240 || o.Left+o.Right >= 256 {
+		return fmt.Errorf("invalid overscan %+v: crops the entire frame", o)
+	}
+	return nil
+}
+
+// frameRect returns the part of the 256x240 frame that is visible after
+// overscan cropping.
+func (g *Game) frameRect() image.Rectangle {
+	return image.Rect(g.overscan.Left, g.overscan.Top, 256-g.overscan.Right, 240-g.overscan.Bottom)
+}
+
+// ppuColor returns the 9-bit NES color for palette RAM address a, applying
+// PPUMASK grayscale (bit 0) and color emphasis (bits 5..7).
+func (g *Game) ppuColor(a uint16) uint16 {
+	c := g.paletteram[paletteAddr(a)] & 0x3f
+	if g.ppumask&1 != 0 {
+		c &= 0x30
+	}
+	return g.emphasis()<<6 | uint16(c)
+}
+
+// emphasis returns the PPUMASK color emphasis bits as red, green, blue from
+// bit 0 up, with the red and green bits swapped back on consoles that swap
+// them.
+func (g *Game) emphasis() uint16 {
+	e := g.ppumask >> 5
+	if g.region.SwapEmphasis {
+		e = e&4 | e>>1&1 | e<<1&2
+	}
+	return uint16(e)
+}
+
+// renderFrame converts the PPU's color indices to RGBA, and runs the NTSC
+// filter if it is enabled.
+func (g *Game) renderFrame() {
+	for i, c := range g.pixels {
+		copy(g.frameBuffer[i*4:i*4+4], g.palette[c][:])
+	}
+	if g.ntscPreset >= 0 {
+		g.ntsc.render(&g.pixels, g.palette, ntscPresets[g.ntscPreset], g.frame)
+	}
+}
+
+// setNTSCPreset selects the NTSC filter preset at index i into ntscPresets, or
+// disables the filter if i is -1.
+func (g *Game) setNTSCPreset(i int) {
+	if i >= 0 && g.ntsc == nil {
+		g.ntsc = newNTSCFilter()
+	}
+	g.ntscPreset = i
+}
+
+// cycleNTSCPreset switches to the next NTSC filter preset, going through "off"
+// after the last one.
+func (g *Game) cycleNTSCPreset() {
+	i := g.ntscPreset + 1
+	if i == len(ntscPresets) {
+		i = -1
+	}
+	g.setNTSCPreset(i)
+	g.renderFrame()
+}
+
+func (g *Game) Draw(screen *ebiten.Image) {
+	r := g.frameRect()
+
+	if g.ntscPreset >= 0 {
+		if g.ntscImage == nil {
+			g.ntscImage = ebiten.NewImage(ntscWidth, 240)
+		}
+		g.ntscImage.WritePixels(g.ntsc.out)
+		// Crop the same part of the frame and double the height to keep the
+		// aspect ratio.
+		src := image.Rect(r.Min.X*ntscWidth/256, r.Min.Y, r.Max.X*ntscWidth/256, r.Max.Y)
+		op := &ebiten.DrawImageOptions{}
+		op.GeoM.Scale(1, 2)
+		op.Filter = ebiten.FilterLinear
+		screen.DrawImage(g.ntscImage.SubImage(src).(*ebiten.Image), op)
+		return
+	}
+
+	if g.frameImage == nil {
+		g.frameImage = ebiten.NewImage(256, 240)
+	}
+	g.frameImage.WritePixels(g.frameBuffer)
+	screen.DrawImage(g.frameImage.SubImage(r).(*ebiten.Image), nil)
+}
+
 func (g *Game) Layout(outsideWidth, outsideHeight int) (screenWidth, screenHeight int) {
-	return 256, 224
+	r := g.frameRect()
+	if g.ntscPreset >= 0 {
+		return r.Max.X*ntscWidth/256 - r.Min.X*ntscWidth/256, r.Dy() * 2
+	}
+	return r.Dx(), r.Dy()
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// testROM returns an iNES image with the given mapper, 16k PRG banks and 8k
+// CHR banks, all zero.
+func testROM(mapper, prgBanks, chrBanks byte) []byte {
+	rom := []byte{'N', 'E', 'S', 0x1a, prgBanks, chrBanks, mapper << 4, mapper & 0xf0, 0, 0, 0, 0, 0, 0, 0, 0}
+	return append(rom, make([]byte, int(prgBanks)*16384+int(chrBanks)*8192)...)
+}
+
+func TestNewGameErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rom  []byte
+		want error
+	}{
+		{"mapper 5", testROM(5, 1, 1), ErrUnsupportedMapper},
+		// NES 2.0 exponent-multiplier size: 1 << 12 bytes.
+		{"4k PRG", append([]byte{'N', 'E', 'S', 0x1a, 12 << 2, 0, 0, 0x08, 0, 0x0f, 0, 0, 0, 0, 0, 0}, make([]byte, 4096)...), ErrUnsupportedROMSize},
+		{"3 PRG banks", testROM(1, 3, 1), ErrUnsupportedROMSize},
+		{"NROM 64k PRG", testROM(0, 4, 1), ErrUnsupportedROMSize},
+		{"NROM 16k CHR", testROM(0, 2, 2), ErrUnsupportedROMSize},
+		{"MMC1 512k PRG", testROM(1, 32, 1), ErrUnsupportedROMSize},
+		{"UxROM 1M PRG", testROM(2, 64, 0), ErrUnsupportedROMSize},
+		{"CNROM 64k CHR", testROM(3, 2, 8), ErrUnsupportedROMSize},
+		{"MMC3 512k CHR", testROM(4, 2, 64), ErrUnsupportedROMSize},
+		{"AxROM 512k PRG", testROM(7, 32, 0), ErrUnsupportedROMSize},
+	}
+	for _, tt := range tests {
+		if _, err := NewGame(tt.rom); !errors.Is(err, tt.want) {
+			t.Errorf("%s: NewGame() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestNewGameLargestROMs(t *testing.T) {
+	for mapper, l := range mapperLimits {
+		rom := testROM(byte(mapper), byte(l.prg>>14), byte(l.chr>>13))
+		if _, err := NewGame(rom); err != nil {
+			t.Errorf("mapper %d: NewGame() error = %v", mapper, err)
+		}
+	}
+}
+
+func FuzzNewGame(f *testing.F) {
+	for _, mapper := range []byte{0, 1, 2, 3, 4, 7} {
+		f.Add(testROM(mapper, 2, 1))
+	}
+	f.Add(testROM(0, 1, 0))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		g, err := NewGame(data)
+		if err != nil {
+			return
+		}
+		for range 3 {
+			g.runFrame()
+		}
+	})
+}
+
+// testGame returns a console with an NROM cartridge whose PPU advances one dot
+// per runPPU call.
+func testGame(t *testing.T) *Game {
+	t.Helper()
+	g, err := NewGame(testROM(0, 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := *g.region
+	r.DotsPerCPU, r.CPUPerDots = 1, 2
+	g.region = &r
+	return g
+}
+
+// seekPPU moves the PPU to the start of dot at scanline scany, before the dot
+// is processed.
+func seekPPU(g *Game, scany, dot uint16) {
+	g.scany, g.dot = scany, dot
+	g.cycles = 0
+}
+
+func TestVBlank(t *testing.T) {
+	g := testGame(t)
+	g.ppuctrl = 0x80
+	seekPPU(g, 241, 1)
+	g.runPPU()
+	if g.ppustatus&0x80 == 0 {
+		t.Error("vblank flag not set at scanline 241 dot 1")
+	}
+	if g.nmiIRQ != 4 {
+		t.Error("NMI not raised at the start of vblank")
+	}
+	if !g.frameDone {
+		t.Error("frame not finished at the start of vblank")
+	}
+
+	g.ppustatus |= 0xe0
+	seekPPU(g, g.region.preRenderLine(), 1)
+	g.runPPU()
+	if g.ppustatus != 0 {
+		t.Errorf("ppustatus = %#02x on the pre-render line, want 0", g.ppustatus)
+	}
+}
+
+func TestVBlankReadRace(t *testing.T) {
+	tests := []struct {
+		dot        uint16
+		wantRead   byte // Bit 7 of the $2002 read
+		wantStatus byte // Bit 7 of ppustatus at dot 5
+		wantNMI    bool
+	}{
+		{dot: 0, wantRead: 0, wantStatus: 0x80, wantNMI: true},
+		// One dot early: the flag reads clear and is never set.
+		{dot: 1, wantRead: 0, wantStatus: 0, wantNMI: false},
+		// Right as it's set: the flag reads set, but there is no NMI.
+		{dot: 2, wantRead: 0x80, wantStatus: 0, wantNMI: false},
+		{dot: 3, wantRead: 0x80, wantStatus: 0, wantNMI: false},
+		{dot: 4, wantRead: 0x80, wantStatus: 0, wantNMI: true},
+	}
+	for _, tt := range tests {
+		g := testGame(t)
+		g.ppuctrl = 0x80
+		// Read $2002 at tt.dot of the vblank scanline, having run the dots
+		// before it.
+		seekPPU(g, 241, 0)
+		for g.dot < tt.dot {
+			g.runPPU()
+		}
+		read := g.mem(2, 0x20, 0, false) & 0x80
+		for g.dot < 5 {
+			g.runPPU()
+		}
+		if read != tt.wantRead || g.ppustatus&0x80 != tt.wantStatus || (g.nmiIRQ == 4) != tt.wantNMI {
+			t.Errorf("read at dot %d: got read %#02x, status %#02x, NMI %t, want %#02x, %#02x, %t",
+				tt.dot, read, g.ppustatus&0x80, g.nmiIRQ == 4, tt.wantRead, tt.wantStatus, tt.wantNMI)
+		}
+		if g.vblSuppress {
+			t.Errorf("read at dot %d: vblank suppression outlived the frame", tt.dot)
+		}
+	}
+}
+
+func TestOddFrameSkip(t *testing.T) {
+	tests := []struct {
+		oddFrame  bool
+		rendering bool
+		wantDot   uint16 // Dot after dot 339 of the pre-render line
+	}{
+		{oddFrame: false, rendering: true, wantDot: 340},
+		{oddFrame: true, rendering: false, wantDot: 340},
+		{oddFrame: true, rendering: true, wantDot: 0},
+	}
+	for _, tt := range tests {
+		g := testGame(t)
+		g.oddFrame = tt.oddFrame
+		if tt.rendering {
+			g.ppumask = 0x18
+		}
+		seekPPU(g, g.region.preRenderLine(), 339)
+		g.runPPU()
+		if g.dot != tt.wantDot {
+			t.Errorf("odd frame %t, rendering %t: dot = %d, want %d", tt.oddFrame, tt.rendering, g.dot, tt.wantDot)
+		}
+		// Either way, the frame ends, and the next one has the other parity.
+		for g.scany != 0 {
+			g.runPPU()
+		}
+		if g.oddFrame == tt.oddFrame {
+			t.Errorf("odd frame %t, rendering %t: frame parity didn't flip", tt.oddFrame, tt.rendering)
+		}
+	}
+
+	g := testGame(t)
+	r := *g.region
+	r.OddFrameDot = false
+	g.region = &r
+	g.oddFrame, g.ppumask = true, 0x18
+	seekPPU(g, g.region.preRenderLine(), 339)
+	g.runPPU()
+	if g.dot != 340 {
+		t.Errorf("dot = %d without OddFrameDot, want 340", g.dot)
+	}
+}
+
+func TestPPUCTRLNMI(t *testing.T) {
+	tests := []struct {
+		name    string
+		ctrl    byte // PPUCTRL before the write
+		vblank  bool
+		wantNMI bool
+	}{
+		{"enable in vblank", 0, true, true},
+		{"enable outside vblank", 0, false, false},
+		{"already enabled in vblank", 0x80, true, false},
+	}
+	for _, tt := range tests {
+		g := testGame(t)
+		g.ppuctrl = tt.ctrl
+		if tt.vblank {
+			g.ppustatus = 0x80
+		}
+		g.mem(0, 0x20, 0x80, true)
+		if (g.nmiIRQ == 4) != tt.wantNMI {
+			t.Errorf("%s: NMI %t, want %t", tt.name, g.nmiIRQ == 4, tt.wantNMI)
+		}
+	}
+}
+
+func TestControllerPorts(t *testing.T) {
+	g := testGame(t)
+	g.pads = [2]byte{0x01, 0x82} // A on controller 1; B and Right on 2
+	g.mem(0x16, 0x40, 1, true)
+	g.mem(0x16, 0x40, 0, true)
+	// Changes after the latch don't show until the next one.
+	g.pads = [2]byte{}
+
+	var got [2][9]byte
+	for i := range 9 {
+		got[0][i] = g.mem(0x16, 0x40, 0, false)
+		got[1][i] = g.mem(0x17, 0x40, 0, false)
+	}
+	// Buttons come out in nesBtns order, then 1s once all 8 are read.
+	want := [2][9]byte{
+		{1, 0, 0, 0, 0, 0, 0, 0, 1},
+		{0, 1, 0, 0, 0, 0, 0, 1, 1},
+	}
+	if got != want {
+		t.Errorf("reads of $4016/$4017 = %v, want %v", got, want)
+	}
+}
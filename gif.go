@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"math"
+)
+
+// gifFrameStep is how many emulated frames each GIF frame lasts. Browsers slow
+// down GIFs with delays under 2/100 s, so 60 fps can't be shown as is.
+const gifFrameStep = 2
+
+// gifFrame is a frame in the rolling GIF buffer, stored as 6-bit NES color
+// indexes rather than RGBA to keep the buffer small.
+type gifFrame struct {
+	pix      [61440]byte
+	emphasis uint16 // Color emphasis bits, 0..7
+}
+
+// gifBuffer is a ring buffer of the most recent frames for GIF capture.
+type gifBuffer struct {
+	frames []*gifFrame
+	start  int // Index of the oldest frame
+	count  int // Number of frames in the ring
+}
+
+func newGIFBuffer(frames int) *gifBuffer {
+	return &gifBuffer{frames: make([]*gifFrame, frames)}
+}
+
+// capture adds a frame of 9-bit NES colors, evicting the oldest frame if the
+// buffer is full. GIF frames have a single palette, so the whole frame gets
+// emphasis, the emphasis bits of PPUMASK at the end of the frame. Games rarely
+// change emphasis mid-frame.
+func (b *gifBuffer) capture(pixels *[61440]uint16, emphasis uint16) {
+	i := (b.start + b.count) % len(b.frames)
+	if b.count == len(b.frames) {
+		b.start = (b.start + 1) % len(b.frames)
+	} else {
+		b.count++
+	}
+	if b.frames[i] == nil {
+		b.frames[i] = &gifFrame{}
+	}
+	f := b.frames[i]
+
+	for j, c := range pixels {
+		f.pix[j] = byte(c & 0x3f)
+	}
+	f.emphasis = emphasis
+}
+
+// EncodeGIF encodes the frames in the GIF buffer as an animated GIF, cropped
+// by the overscan settings. The NES palette without emphasis is the global
+// color table; frames with emphasis get their own.
+func (g *Game) EncodeGIF() ([]byte, error) {
+	b := g.gif
+	r := g.frameRect()
+
+	var palettes [8]color.Palette
+	for e := range palettes {
+		palettes[e] = make(color.Palette, 64)
+		for c := range 64 {
+			rgba := g.palette[e<<6|c]
+			palettes[e][c] = color.RGBA{rgba[0], rgba[1], rgba[2], 255}
+		}
+	}
+
+	anim := &gif.GIF{
+		Config: image.Config{ColorModel: palettes[0], Width: r.Dx(), Height: r.Dy()},
+	}
+	// Delays are rounded to 1/100 s from the exact frame times, so they
+	// don't drift.
+	frameTime := gifFrameStep / g.region.FrameRate * 100
+	for i := range b.count {
+		f := b.frames[(b.start+i)%len(b.frames)]
+		img := image.NewPaletted(image.Rect(0, 0, r.Dx(), r.Dy()), palettes[f.emphasis])
+		for y := range r.Dy() {
+			copy(img.Pix[y*img.Stride:], f.pix[(r.Min.Y+y)*256+r.Min.X:(r.Min.Y+y)*256+r.Max.X])
+		}
+		delay := math.Round(float64(i+1)*frameTime) - math.Round(float64(i)*frameTime)
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, int(delay))
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"image/gif"
+	"testing"
+)
+
+func TestGIFEmphasis(t *testing.T) {
+	tests := []struct {
+		region *Region
+		mask   byte
+		want   uint16
+	}{
+		{RegionNTSC, 0x00, 0},
+		{RegionNTSC, 0x20, 1},
+		{RegionNTSC, 0x40, 2},
+		{RegionNTSC, 0xe0, 7},
+		// PAL and Dendy swap red and green.
+		{RegionPAL, 0x20, 2},
+		{RegionPAL, 0x40, 1},
+		{RegionDendy, 0xa0, 6},
+	}
+	for _, tt := range tests {
+		g := testGame(t)
+		g.region = tt.region
+		g.gif = newGIFBuffer(4)
+		g.ppumask = tt.mask
+		g.runFrame()
+		g.runFrame()
+		if got := g.gif.frames[0].emphasis; got != tt.want {
+			t.Errorf("%s PPUMASK %#02x: GIF emphasis = %d, want %d", tt.region.Name, tt.mask, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeGIF(t *testing.T) {
+	g := testGame(t)
+	g.gif = newGIFBuffer(3)
+	for range 5 * gifFrameStep {
+		g.runFrame()
+	}
+	b, err := g.EncodeGIF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	anim, err := gif.DecodeAll(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anim.Image) != 3 {
+		t.Errorf("GIF has %d frames, want the last 3", len(anim.Image))
+	}
+	if r := g.frameRect(); anim.Config.Width != r.Dx() || anim.Config.Height != r.Dy() {
+		t.Errorf("GIF is %dx%d, want %dx%d", anim.Config.Width, anim.Config.Height, r.Dx(), r.Dy())
+	}
+}
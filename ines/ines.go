@@ -0,0 +1,292 @@
+// Package ines parses iNES and NES 2.0 ROM images.
+package ines
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	headerSize  = 16
+	trainerSize = 512
+)
+
+var magic = [4]byte{'N', 'E', 'S', 0x1a}
+
+var (
+	// ErrBadMagic is returned when the file doesn't start with "NES\x1a".
+	ErrBadMagic = errors.New("ines: bad magic")
+
+	// ErrTruncated is returned when the file is shorter than its header says.
+	ErrTruncated = errors.New("ines: truncated file")
+
+	// ErrInvalidHeader is returned when the header contains impossible values.
+	ErrInvalidHeader = errors.New("ines: invalid header")
+)
+
+// Mirroring is the nametable mirroring mode.
+type Mirroring byte
+
+const (
+	Horizontal Mirroring = iota // Vertical arrangement, $2000 = $2400
+	Vertical                    // Horizontal arrangement, $2000 = $2800
+	FourScreen                  // Four separate nametables on the cartridge
+
+	// Single-screen modes are never set in the header, only by mappers.
+	SingleScreenA // All nametables map to the first 1k of VRAM
+	SingleScreenB // All nametables map to the second 1k of VRAM
+)
+
+func (m Mirroring) String() string {
+	switch m {
+	case Horizontal:
+		return "horizontal"
+	case Vertical:
+		return "vertical"
+	case FourScreen:
+		return "four-screen"
+	case SingleScreenA:
+		return "single-screen A"
+	case SingleScreenB:
+		return "single-screen B"
+	default:
+		return fmt.Sprintf("Mirroring(%d)", byte(m))
+	}
+}
+
+// Timing is the CPU/PPU timing mode (region).
+type Timing byte
+
+const (
+	TimingNTSC        Timing = iota // RP2C02 ("NTSC NES")
+	TimingPAL                       // RP2C07 ("Licensed PAL NES")
+	TimingMultiRegion               // Multiple-region
+	TimingDendy                     // UA6538 ("Dendy")
+)
+
+func (t Timing) String() string {
+	switch t {
+	case TimingNTSC:
+		return "NTSC"
+	case TimingPAL:
+		return "PAL"
+	case TimingMultiRegion:
+		return "multi-region"
+	case TimingDendy:
+		return "Dendy"
+	default:
+		return fmt.Sprintf("Timing(%d)", byte(t))
+	}
+}
+
+// ConsoleType is the console type from byte 7 (and byte 13 for extended types).
+type ConsoleType byte
+
+const (
+	ConsoleNES        ConsoleType = iota // Nintendo Entertainment System/Family Computer
+	ConsoleVsSystem                      // Nintendo Vs. System
+	ConsolePlayChoice                    // Nintendo PlayChoice-10
+	ConsoleExtended                      // Extended console type, see Cartridge.ExtendedConsoleType
+)
+
+func (c ConsoleType) String() string {
+	switch c {
+	case ConsoleNES:
+		return "NES"
+	case ConsoleVsSystem:
+		return "Vs. System"
+	case ConsolePlayChoice:
+		return "PlayChoice-10"
+	case ConsoleExtended:
+		return "extended"
+	default:
+		return fmt.Sprintf("ConsoleType(%d)", byte(c))
+	}
+}
+
+// Cartridge is a parsed iNES or NES 2.0 ROM image.
+type Cartridge struct {
+	NES20 bool // true if the header is in NES 2.0 format
+
+	Mapper    uint16 // Mapper number (0..4095)
+	Submapper byte   // Submapper number (0..15), NES 2.0 only
+
+	PRGROM  []byte // PRG ROM data
+	CHRROM  []byte // CHR ROM data, empty if the board uses CHR RAM
+	Trainer []byte // 512-byte trainer, nil if not present
+	MiscROM []byte // Miscellaneous ROM data following CHR ROM
+
+	PRGRAMSize   int // Volatile PRG RAM size in bytes
+	PRGNVRAMSize int // Non-volatile (battery-backed) PRG RAM size in bytes
+	CHRRAMSize   int // Volatile CHR RAM size in bytes
+	CHRNVRAMSize int // Non-volatile CHR RAM size in bytes
+
+	Mirroring Mirroring // Hard-wired nametable mirroring
+	Battery   bool      // true if the cartridge contains battery-backed memory
+
+	Timing              Timing      // CPU/PPU timing
+	ConsoleType         ConsoleType // Console type
+	VsPPUType           byte        // Vs. System PPU type, only if ConsoleType is ConsoleVsSystem
+	VsHardwareType      byte        // Vs. System hardware type, only if ConsoleType is ConsoleVsSystem
+	ExtendedConsoleType byte        // Extended console type, only if ConsoleType is ConsoleExtended
+
+	MiscROMs        int  // Number of miscellaneous ROMs, NES 2.0 only
+	ExpansionDevice byte // Default expansion device, NES 2.0 only
+}
+
+// Parse parses an iNES or NES 2.0 ROM image. The returned Cartridge's ROM
+// slices alias data.
+func Parse(data []byte) (*Cartridge, error) {
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("%w: file too short for header: %d bytes", ErrTruncated, len(data))
+	}
+	if [4]byte(data[0:4]) != magic {
+		return nil, fmt.Errorf("%w %q", ErrBadMagic, data[0:4])
+	}
+
+	h := data[:headerSize]
+	c := &Cartridge{
+		Battery:     h[6]&0x02 != 0,
+		ConsoleType: ConsoleType(h[7] & 3),
+	}
+
+	switch {
+	case h[6]&0x08 != 0:
+		c.Mirroring = FourScreen
+	case h[6]&0x01 != 0:
+		c.Mirroring = Vertical
+	default:
+		c.Mirroring = Horizontal
+	}
+
+	var prgSize, chrSize int
+	if h[7]&0x0c == 0x08 {
+		c.NES20 = true
+		if err := c.parseNES20(h, &prgSize, &chrSize); err != nil {
+			return nil, err
+		}
+	} else {
+		c.parseINES(h, &prgSize, &chrSize)
+	}
+
+	rest := data[headerSize:]
+	if h[6]&0x04 != 0 {
+		if len(rest) < trainerSize {
+			return nil, fmt.Errorf("%w: trainer: want %d bytes, have %d", ErrTruncated, trainerSize, len(rest))
+		}
+		c.Trainer = rest[:trainerSize]
+		rest = rest[trainerSize:]
+	}
+
+	if prgSize == 0 {
+		return nil, fmt.Errorf("%w: PRG ROM size is zero", ErrInvalidHeader)
+	}
+	if len(rest) < prgSize {
+		return nil, fmt.Errorf("%w: PRG ROM: want %d bytes, have %d", ErrTruncated, prgSize, len(rest))
+	}
+	c.PRGROM = rest[:prgSize:prgSize]
+	rest = rest[prgSize:]
+
+	if len(rest) < chrSize {
+		return nil, fmt.Errorf("%w: CHR ROM: want %d bytes, have %d", ErrTruncated, chrSize, len(rest))
+	}
+	c.CHRROM = rest[:chrSize:chrSize]
+	rest = rest[chrSize:]
+
+	if len(rest) > 0 {
+		c.MiscROM = rest
+	}
+
+	return c, nil
+}
+
+func (c *Cartridge) parseINES(h []byte, prgSize, chrSize *int) {
+	*prgSize = int(h[4]) << 14
+	*chrSize = int(h[5]) << 13
+
+	c.Mapper = uint16(h[6] >> 4)
+	ramSize := 8192
+	// Some old dumping tools wrote garbage like "DiskDude!" into bytes 7..15.
+	// If the padding isn't zero, nothing past byte 6 can be trusted, so fall
+	// back to 8k of PRG RAM and NTSC.
+	if h[12] == 0 && h[13] == 0 && h[14] == 0 && h[15] == 0 {
+		c.Mapper |= uint16(h[7] & 0xf0)
+		// Byte 8 is the PRG RAM size in 8k units; 0 infers 8k for compatibility.
+		if h[8] != 0 {
+			ramSize = int(h[8]) << 13
+		}
+		if h[9]&1 != 0 {
+			c.Timing = TimingPAL
+		}
+	} else {
+		c.ConsoleType = ConsoleNES
+	}
+
+	if c.Battery {
+		c.PRGNVRAMSize = ramSize
+	} else {
+		c.PRGRAMSize = ramSize
+	}
+	if *chrSize == 0 {
+		c.CHRRAMSize = 8192
+	}
+}
+
+func (c *Cartridge) parseNES20(h []byte, prgSize, chrSize *int) error {
+	c.Mapper = uint16(h[6]>>4) | uint16(h[7]&0xf0) | uint16(h[8]&0x0f)<<8
+	c.Submapper = h[8] >> 4
+
+	var err error
+	if *prgSize, err = romSize(h[4], h[9]&0x0f, 16384); err != nil {
+		return fmt.Errorf("%w: PRG ROM size: %w", ErrInvalidHeader, err)
+	}
+	if *chrSize, err = romSize(h[5], h[9]>>4, 8192); err != nil {
+		return fmt.Errorf("%w: CHR ROM size: %w", ErrInvalidHeader, err)
+	}
+
+	c.PRGRAMSize = ramSize(h[10] & 0x0f)
+	c.PRGNVRAMSize = ramSize(h[10] >> 4)
+	c.CHRRAMSize = ramSize(h[11] & 0x0f)
+	c.CHRNVRAMSize = ramSize(h[11] >> 4)
+
+	c.Timing = Timing(h[12] & 3)
+
+	switch c.ConsoleType {
+	case ConsoleVsSystem:
+		c.VsPPUType = h[13] & 0x0f
+		c.VsHardwareType = h[13] >> 4
+	case ConsoleExtended:
+		c.ExtendedConsoleType = h[13] & 0x0f
+	}
+
+	c.MiscROMs = int(h[14] & 3)
+	c.ExpansionDevice = h[15] & 0x3f
+
+	return nil
+}
+
+// romSize decodes a NES 2.0 ROM size from its LSB and MSB nibble. If the MSB
+// nibble is $F, the LSB is in exponent-multiplier notation.
+func romSize(lsb, msb byte, unit int) (int, error) {
+	if msb != 0x0f {
+		return (int(msb)<<8 | int(lsb)) * unit, nil
+	}
+	exp := lsb >> 2
+	mul := int(lsb&3)*2 + 1
+	// Anything this big can't possibly be a real ROM, and on 32-bit
+	// platforms it would overflow.
+	if exp > 30 || mul > math.MaxInt>>exp {
+		return 0, fmt.Errorf("exponent %d too large", exp)
+	}
+	return mul << exp, nil
+}
+
+// ramSize decodes a NES 2.0 RAM shift count. 0 means no RAM, otherwise the
+// size is 64 << shift bytes.
+func ramSize(shift byte) int {
+	if shift == 0 {
+		return 0
+	}
+	return 64 << shift
+}
@@ -0,0 +1,141 @@
+package ines
+
+import (
+	"errors"
+	"testing"
+)
+
+func header(b4, b5, b6, b7 byte) []byte {
+	return []byte{'N', 'E', 'S', 0x1a, b4, b5, b6, b7, 0, 0, 0, 0, 0, 0, 0, 0}
+}
+
+func TestParse(t *testing.T) {
+	rom := append(header(2, 1, 0x13, 0x10), make([]byte, 2*16384+8192)...)
+	c, err := Parse(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Mapper != 0x11 {
+		t.Errorf("Mapper = %d, want %d", c.Mapper, 0x11)
+	}
+	if c.Mirroring != Vertical {
+		t.Errorf("Mirroring = %v, want %v", c.Mirroring, Vertical)
+	}
+	if !c.Battery || c.PRGNVRAMSize != 8192 {
+		t.Errorf("Battery = %v, PRGNVRAMSize = %d, want true, 8192", c.Battery, c.PRGNVRAMSize)
+	}
+	if len(c.PRGROM) != 2*16384 || len(c.CHRROM) != 8192 {
+		t.Errorf("PRG ROM = %d, CHR ROM = %d bytes, want %d, %d", len(c.PRGROM), len(c.CHRROM), 2*16384, 8192)
+	}
+}
+
+func TestParseNES20(t *testing.T) {
+	h := header(0x07, 0, 0x40, 0x08) // PRG: 2^1 * 7 = 14 bytes via exponent-multiplier
+	h[8] = 0x31                      // submapper 3, mapper bits 8..11 = 1
+	h[9] = 0x0f
+	h[10] = 0x70 // 8k PRG NVRAM
+	h[11] = 0x09 // 32k CHR RAM
+	h[12] = 0x03 // Dendy
+	c, err := Parse(append(h, make([]byte, 14)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Mapper != 0x104 || c.Submapper != 3 {
+		t.Errorf("Mapper = %d.%d, want %d.%d", c.Mapper, c.Submapper, 0x104, 3)
+	}
+	if len(c.PRGROM) != 14 {
+		t.Errorf("PRG ROM = %d bytes, want 14", len(c.PRGROM))
+	}
+	if c.PRGNVRAMSize != 8192 || c.CHRRAMSize != 32768 {
+		t.Errorf("PRGNVRAMSize = %d, CHRRAMSize = %d, want 8192, 32768", c.PRGNVRAMSize, c.CHRRAMSize)
+	}
+	if c.Timing != TimingDendy {
+		t.Errorf("Timing = %v, want %v", c.Timing, TimingDendy)
+	}
+}
+
+func TestParseDiskDude(t *testing.T) {
+	h := header(1, 1, 0x10, 0)
+	copy(h[7:], "DiskDude!")
+	c, err := Parse(append(h, make([]byte, 16384+8192)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Mapper != 1 {
+		t.Errorf("Mapper = %d, want 1", c.Mapper)
+	}
+	if c.PRGRAMSize != 8192 {
+		t.Errorf("PRGRAMSize = %d, want 8192", c.PRGRAMSize)
+	}
+	if c.Timing != TimingNTSC {
+		t.Errorf("Timing = %v, want %v", c.Timing, TimingNTSC)
+	}
+}
+
+func TestROMSize(t *testing.T) {
+	tests := []struct {
+		lsb, msb byte
+		want     int
+		wantErr  bool
+	}{
+		{2, 0, 2 * 16384, false},
+		{0x34, 1, 0x134 * 16384, false},
+		{0x07, 0x0f, 7 << 1, false},
+		{30<<2 | 0, 0x0f, 1 << 30, false},
+		{31 << 2, 0x0f, 0, true},
+		{0xff, 0x0f, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := romSize(tt.lsb, tt.msb, 16384)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("romSize(%#x, %#x) = %d, %v, want %d, error %v", tt.lsb, tt.msb, got, err, tt.want, tt.wantErr)
+		}
+	}
+	// No exponent-multiplier size may overflow, whatever the size of int.
+	for lsb := range 256 {
+		if got, err := romSize(byte(lsb), 0x0f, 16384); err == nil && got <= 0 {
+			t.Errorf("romSize(%#x, 0xf) = %d, overflowed", lsb, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrTruncated},
+		{"bad magic", []byte("NES\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), ErrBadMagic},
+		{"no PRG", header(0, 0, 0, 0), ErrInvalidHeader},
+		{"short PRG", append(header(1, 0, 0, 0), make([]byte, 100)...), ErrTruncated},
+		{"short CHR", append(header(1, 1, 0, 0), make([]byte, 16384)...), ErrTruncated},
+		{"short trainer", header(1, 0, 4, 0), ErrTruncated},
+		{"huge exponent", func() []byte { h := header(0xfc, 0, 0, 8); h[9] = 0x0f; return h }(), ErrInvalidHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.data); !errors.Is(err, tt.want) {
+				t.Errorf("Parse() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(append(header(1, 1, 0, 0), make([]byte, 16384+8192)...))
+	f.Add(append(header(1, 0, 0x04, 0x08), make([]byte, 512+16384)...))
+	f.Add(header(0xff, 0xff, 0xff, 0xff))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c, err := Parse(data)
+		if err != nil {
+			return
+		}
+		if len(c.PRGROM) == 0 {
+			t.Error("Parse() returned empty PRG ROM without error")
+		}
+		if n := headerSize + len(c.Trainer) + len(c.PRGROM) + len(c.CHRROM) + len(c.MiscROM); n != len(data) {
+			t.Errorf("ROM sections add up to %d bytes, want %d", n, len(data))
+		}
+	})
+}
@@ -13,6 +13,7 @@ const (
 	ActionRight
 )
 
+// keymap is the default keymap, used when the config file doesn't override it.
 var keymap input.Keymap = input.Keymap{
 	ActionA:      {input.KeyX, input.KeyGamepadA},
 	ActionB:      {input.KeyZ, input.KeyGamepadB},
@@ -24,6 +25,18 @@ var keymap input.Keymap = input.Keymap{
 	ActionRight:  {input.KeyRight, input.KeyGamepadRight},
 }
 
+// keymap2 is the default keymap of controller 2.
+var keymap2 input.Keymap = input.Keymap{
+	ActionA:      {input.KeyG, input.KeyGamepadA},
+	ActionB:      {input.KeyF, input.KeyGamepadB},
+	ActionSelect: {input.KeyQ, input.KeyGamepadHome},
+	ActionStart:  {input.KeyE, input.KeyGamepadStart},
+	ActionUp:     {input.KeyW, input.KeyGamepadUp},
+	ActionDown:   {input.KeyS, input.KeyGamepadDown},
+	ActionLeft:   {input.KeyA, input.KeyGamepadLeft},
+	ActionRight:  {input.KeyD, input.KeyGamepadRight},
+}
+
 var nesBtns = []input.Action{
 	ActionA,
 	ActionB,
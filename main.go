@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 
@@ -70,14 +76,290 @@ func main() {
 		handleError(fmt.Errorf("failed to initialize game: %w", err))
 	}
 
+	region, err := parseRegion(*regionFlag)
+	if err != nil {
+		slog.Error("invalid region", "error", err)
+		handleError(err)
+	}
+	if region != nil {
+		g.region = region
+	}
+	slog.Info("region", "region", g.region.Name)
+
+	if *fastForwardFlag < 0 {
+		slog.Error("invalid fast-forward speed", "speed", *fastForwardFlag)
+		handleError(fmt.Errorf("invalid fast-forward speed %v: must not be negative", *fastForwardFlag))
+	}
+	g.fastForward = *fastForwardFlag
+	if *slowMotionFlag <= 0 || *slowMotionFlag > 1 {
+		slog.Error("invalid slow motion speed", "speed", *slowMotionFlag)
+		handleError(fmt.Errorf("invalid slow motion speed %v: must be between 0 and 1", *slowMotionFlag))
+	}
+	g.slowMotionSpeed = *slowMotionFlag
+
+	g.overscan = Overscan{
+		Top:    *overscanTopFlag,
+		Bottom: *overscanBottomFlag,
+		Left:   *overscanLeftFlag,
+		Right:  *overscanRightFlag,
+	}
+	if err := g.overscan.Validate(); err != nil {
+		slog.Error("invalid overscan", "error", err)
+		handleError(err)
+	}
+
+	g.noSpriteLimit = *noSpriteLimitFlag
+
+	configPath := *configFlag
+	if configPath == "" {
+		if configPath, err = defaultConfigPath(); err != nil {
+			slog.Error("failed to find config directory", "error", err)
+			handleError(fmt.Errorf("failed to find config directory: %w", err))
+		}
+	}
+	slog.Info("loading config", "path", configPath)
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		slog.Error("failed to load config", "path", configPath, "error", err)
+		handleError(fmt.Errorf("failed to load config: %w", err))
+	}
+	for player, m := range []map[string][]string{cfg.Player1, cfg.Player2} {
+		km, err := parseKeymap(m)
+		if err != nil {
+			slog.Error("invalid key bindings", "path", configPath, "player", player+1, "error", err)
+			handleError(fmt.Errorf("invalid key bindings for player %d in %s: %w", player+1, configPath, err))
+		}
+		g.SetKeymap(player, km)
+	}
+
+	if *gammaFlag <= 0 {
+		slog.Error("invalid gamma", "gamma", *gammaFlag)
+		handleError(fmt.Errorf("invalid gamma %v: must be positive", *gammaFlag))
+	}
+	setCompositeParams(PaletteParams{
+		Hue:        *hueFlag,
+		Saturation: *saturationFlag,
+		Contrast:   *contrastFlag,
+		Brightness: *brightnessFlag,
+		Gamma:      *gammaFlag,
+	})
+	pal, err := loadPalette(*paletteFlag)
+	if err != nil {
+		slog.Error("failed to load palette", "palette", *paletteFlag, "error", err)
+		handleError(fmt.Errorf("failed to load palette: %w", err))
+	}
+	// Cycle through the selected palette first, followed by the built-in ones.
+	palettes := []namedPalette{pal}
+	for _, p := range builtinPalettes {
+		if p != pal {
+			palettes = append(palettes, p)
+		}
+	}
+	g.setPalettes(palettes)
+
+	preset, err := ntscPreset(*ntscFlag)
+	if err != nil {
+		slog.Error("invalid NTSC filter preset", "error", err)
+		handleError(err)
+	}
+	g.setNTSCPreset(preset)
+
+	if g.cart.Battery {
+		sav := savePath(path, *saveDirFlag, ".sav")
+		slog.Info("loading battery-backed RAM", "path", sav)
+		if err := g.LoadSRAM(sav); err != nil {
+			slog.Error("failed to load battery-backed RAM", "path", sav, "error", err)
+			handleError(fmt.Errorf("failed to load save file: %w", err))
+		}
+	}
+
+	g.statePath = func(slot int) string {
+		return savePath(path, *saveDirFlag, fmt.Sprintf(".ss%d", slot))
+	}
+
+	g.romName = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	g.screenshotDir = *screenshotDirFlag
+	if g.screenshotDir == "" {
+		g.screenshotDir = filepath.Dir(path)
+	}
+	if *screenshotScaleFlag < 1 {
+		slog.Error("invalid screenshot scale", "scale", *screenshotScaleFlag)
+		handleError(fmt.Errorf("invalid screenshot scale %d: must be at least 1", *screenshotScaleFlag))
+	}
+	g.screenshotScale = *screenshotScaleFlag
+
+	if *playMovieFlag != "" && *recordMovieFlag != "" {
+		slog.Error("-play-movie and -record-movie can't be used together")
+		handleError(errors.New("-play-movie and -record-movie can't be used together"))
+	}
+	if *headlessFlag && *playMovieFlag == "" {
+		slog.Error("-headless needs -play-movie")
+		handleError(errors.New("-headless needs -play-movie"))
+	}
+	if *playMovieFlag != "" {
+		m, err := readMovie(*playMovieFlag)
+		if err != nil {
+			slog.Error("failed to read movie", "path", *playMovieFlag, "error", err)
+			handleError(fmt.Errorf("failed to read movie: %w", err))
+		}
+		if m.PAL && region == nil && g.region != RegionPAL {
+			slog.Warn("movie was recorded on PAL, switching region")
+			g.region = RegionPAL
+		}
+		slog.Info("playing movie", "path", *playMovieFlag, "frames", len(m.Frames))
+		g.PlayMovie(m)
+	}
+	if *recordMovieFlag != "" {
+		slog.Info("recording movie", "path", *recordMovieFlag)
+		g.RecordMovie(NewMovie(g.cart, filepath.Base(path)))
+	}
+
+	// The GIF and rewind buffers are sized in frames, so they are allocated
+	// once the movie has settled the region.
+	if *gifSecondsFlag > 0 {
+		g.gif = newGIFBuffer(int(math.Round(float64(*gifSecondsFlag) * g.region.FrameRate / gifFrameStep)))
+	}
+
+	if *rewindFlag > 0 {
+		g.rewind = newRewindBuffer(int(math.Round(float64(*rewindFlag) * g.region.FrameRate)))
+	}
+
+	if (*hashesFlag != "" || *goldenFlag != "" || *screenshotFlag) && !*headlessFlag {
+		slog.Error("-hashes, -golden and -screenshot need -headless")
+		handleError(errors.New("-hashes, -golden and -screenshot need -headless"))
+	}
+	if *recordVideoFlag != "" {
+		slog.Info("recording video", "path", *recordVideoFlag)
+		if err := g.StartVideo(*recordVideoFlag); err != nil {
+			slog.Error("failed to start video recording", "error", err)
+			handleError(fmt.Errorf("failed to start video recording: %w", err))
+		}
+	}
+
+	if *headlessFlag {
+		err := runHeadless(g)
+		if err := g.StopVideo(); err != nil {
+			slog.Error("failed to finish video", "error", err)
+		}
+		if err != nil {
+			slog.Error("headless run failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	slog.Info("initializing ebiten")
 	g.InitEbiten()
 
 	slog.Info("starting game")
-	if err := g.Start(); err != nil {
-		slog.Error("game exited with error", "error", err)
-		handleError(fmt.Errorf("game exited with error: %w", err))
+	runErr := g.Start()
+
+	if err := g.StopVideo(); err != nil {
+		slog.Error("failed to finish video", "error", err)
+	}
+
+	if *recordMovieFlag != "" {
+		if err := writeMovie(*recordMovieFlag, g.movie); err != nil {
+			slog.Error("failed to write movie", "path", *recordMovieFlag, "error", err)
+			handleError(fmt.Errorf("failed to write movie: %w", err))
+		}
+	}
+
+	// Flush battery-backed RAM even if the game crashed, so progress isn't lost.
+	if err := g.SaveSRAM(); err != nil {
+		slog.Error("failed to save battery-backed RAM", "error", err)
+		handleError(fmt.Errorf("failed to save battery-backed RAM: %w", err))
+	}
+
+	if runErr != nil {
+		slog.Error("game exited with error", "error", runErr)
+		handleError(fmt.Errorf("game exited with error: %w", runErr))
+	}
+}
+
+// runHeadless plays back the movie without a window, writing the frame hashes
+// to -hashes and comparing them with -golden if set.
+func runHeadless(g *Game) (err error) {
+	var out io.Writer
+	switch *hashesFlag {
+	case "":
+	case "-":
+		out = os.Stdout
+	default:
+		var f *os.File
+		if f, err = os.Create(*hashesFlag); err != nil {
+			return err
+		}
+		// The hashes are only complete once they are flushed and closed.
+		bw := bufio.NewWriter(f)
+		defer func() {
+			err = errors.Join(err, bw.Flush(), f.Close())
+		}()
+		out = bw
+	}
+
+	var golden []FrameHash
+	if *goldenFlag != "" {
+		f, err := os.Open(*goldenFlag)
+		if err != nil {
+			return err
+		}
+		golden, err = ReadFrameHashes(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read golden file: %w", err)
+		}
+		if len(golden) == 0 {
+			return fmt.Errorf("golden file %s has no frame hashes", *goldenFlag)
+		}
+	}
+
+	g.rewind = nil
+	for i := 0; int(g.frame) < len(g.movie.Frames); i++ {
+		g.runFrame()
+		h := g.FrameHash()
+		if out != nil {
+			fmt.Fprintln(out, h)
+		}
+		if *goldenFlag != "" {
+			if i >= len(golden) {
+				return fmt.Errorf("golden file ends at frame %d", h.Frame)
+			}
+			if h != golden[i] {
+				return fmt.Errorf("frame hash mismatch: got %v, want %v", h, golden[i])
+			}
+		}
+	}
+	if *goldenFlag != "" && len(golden) > len(g.movie.Frames) {
+		return fmt.Errorf("movie ended after %d frames, golden file has %d", len(g.movie.Frames), len(golden))
+	}
+	slog.Info("movie finished", "frames", g.frame)
+
+	if *screenshotFlag {
+		path, err := g.SaveScreenshot(g.screenshotDir, g.screenshotScale)
+		if err != nil {
+			return fmt.Errorf("failed to save screenshot: %w", err)
+		}
+		slog.Info("saved screenshot", "path", path)
+	}
+	return nil
+}
+
+func readMovie(path string) (*Movie, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadFM2(f)
+}
+
+func writeMovie(path string, m *Movie) error {
+	var buf bytes.Buffer
+	if err := m.WriteFM2(&buf); err != nil {
+		return err
 	}
+	return writeFileAtomic(path, buf.Bytes())
 }
 
 func handleError(err error) {
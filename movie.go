@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/MatusOllah/smolnes-go/ines"
+)
+
+// Movie commands, with the same values as in FM2.
+const (
+	CommandReset byte = 1 << 0 // Press the reset button
+	CommandPower byte = 1 << 1 // Power cycle the console
+)
+
+// fm2Buttons are the FM2 button letters, from bit 7 down to bit 0 of a pad.
+const fm2Buttons = "RLDUTSBA"
+
+// ErrMovieFormat is returned when a movie file can't be parsed.
+var ErrMovieFormat = errors.New("invalid movie")
+
+// MovieFrame is the input for one frame.
+type MovieFrame struct {
+	Commands byte    // CommandReset, CommandPower
+	Pads     [2]byte // Controller state, bit i set if nesBtns[i] is pressed
+}
+
+// Movie is a recording of the input for every frame since power-on, in
+// FCEUX's FM2 format.
+type Movie struct {
+	ROMFilename string
+	ROMChecksum [md5.Size]byte // MD5 of PRG and CHR ROM
+	PAL         bool
+	Rerecords   int
+	GUID        string
+	Comments    []string
+	Frames      []MovieFrame
+}
+
+// romMD5 returns the ROM checksum used by FM2 movies.
+func romMD5(cart *ines.Cartridge) (sum [md5.Size]byte) {
+	h := md5.New()
+	h.Write(cart.PRGROM)
+	h.Write(cart.CHRROM)
+	h.Sum(sum[:0])
+	return sum
+}
+
+// NewMovie returns an empty movie for cart.
+func NewMovie(cart *ines.Cartridge, romFilename string) *Movie {
+	var guid [16]byte
+	rand.Read(guid[:])
+	return &Movie{
+		ROMFilename: romFilename,
+		ROMChecksum: romMD5(cart),
+		PAL:         cart.Timing == ines.TimingPAL,
+		GUID:        fmt.Sprintf("%X-%X-%X-%X-%X", guid[0:4], guid[4:6], guid[6:8], guid[8:10], guid[10:16]),
+	}
+}
+
+// ReadFM2 parses a movie in FM2 text format. Binary FM2 movies and movies that
+// start from a save state aren't supported.
+func ReadFM2(r io.Reader) (*Movie, error) {
+	m := &Movie{}
+	ports := [2]bool{true, true}
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimRight(sc.Text(), "\r")
+		if s == "" {
+			continue
+		}
+		if s[0] == '|' {
+			f, err := parseFM2Frame(s, ports)
+			if err != nil {
+				return nil, fmt.Errorf("%w: line %d: %w", ErrMovieFormat, line, err)
+			}
+			m.Frames = append(m.Frames, f)
+			continue
+		}
+
+		key, value, _ := strings.Cut(s, " ")
+		var err error
+		switch key {
+		case "version":
+			if value != "3" {
+				err = fmt.Errorf("unsupported version %q", value)
+			}
+		case "binary":
+			if value != "0" {
+				err = errors.New("binary movies aren't supported")
+			}
+		case "savestate":
+			err = errors.New("movies starting from a save state aren't supported")
+		case "fourscore":
+			if value != "0" {
+				err = errors.New("Four Score movies aren't supported")
+			}
+		case "port0", "port1":
+			// 0 is no controller, 1 is a gamepad.
+			if value != "0" && value != "1" {
+				err = fmt.Errorf("unsupported %s device %q", key, value)
+			}
+			ports[key[4]-'0'] = value == "1"
+		case "romFilename":
+			m.ROMFilename = value
+		case "romChecksum":
+			b, ok := strings.CutPrefix(value, "base64:")
+			var sum []byte
+			if ok {
+				sum, err = base64.StdEncoding.DecodeString(b)
+			}
+			if !ok || err != nil || len(sum) != md5.Size {
+				err = fmt.Errorf("bad ROM checksum %q", value)
+			}
+			copy(m.ROMChecksum[:], sum)
+		case "palFlag":
+			m.PAL = value == "1"
+		case "rerecordCount":
+			m.Rerecords, err = strconv.Atoi(value)
+		case "guid":
+			m.GUID = value
+		case "comment":
+			m.Comments = append(m.Comments, value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", ErrMovieFormat, line, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// parseFM2Frame parses an input line like "|0|R..U....|........||". ports says
+// which ports have a gamepad, and therefore a field in the line.
+func parseFM2Frame(s string, ports [2]bool) (f MovieFrame, err error) {
+	fields := strings.Split(s, "|")
+	// The line starts and ends with "|", so the first and last fields are
+	// empty. In between are the commands and one field per port, of which
+	// the third is always empty.
+	if len(fields) < 4 {
+		return f, fmt.Errorf("bad input line %q", s)
+	}
+	commands, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return f, fmt.Errorf("bad commands %q", fields[1])
+	}
+	f.Commands = byte(commands)
+	for i, ok := range ports {
+		if !ok {
+			continue
+		}
+		if len(fields) < 3+i || len(fields[2+i]) != len(fm2Buttons) {
+			return f, fmt.Errorf("bad port %d input in %q", i, s)
+		}
+		for j, c := range fields[2+i] {
+			// Anything but a space or a dot means the button is pressed.
+			if c != ' ' && c != '.' {
+				f.Pads[i] |= 1 << (7 - j)
+			}
+		}
+	}
+	return f, nil
+}
+
+// WriteFM2 writes the movie in FM2 text format.
+func (m *Movie) WriteFM2(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "version 3\n")
+	fmt.Fprintf(bw, "rerecordCount %d\n", m.Rerecords)
+	fmt.Fprintf(bw, "palFlag %d\n", bool2byte(m.PAL))
+	fmt.Fprintf(bw, "romFilename %s\n", m.ROMFilename)
+	fmt.Fprintf(bw, "romChecksum base64:%s\n", base64.StdEncoding.EncodeToString(m.ROMChecksum[:]))
+	fmt.Fprintf(bw, "guid %s\n", m.GUID)
+	fmt.Fprintf(bw, "fourscore 0\n")
+	fmt.Fprintf(bw, "microphone 0\n")
+	fmt.Fprintf(bw, "port0 1\n")
+	fmt.Fprintf(bw, "port1 1\n")
+	fmt.Fprintf(bw, "port2 0\n")
+	fmt.Fprintf(bw, "FDS 0\n")
+	fmt.Fprintf(bw, "NewPPU 0\n")
+	for _, c := range m.Comments {
+		fmt.Fprintf(bw, "comment %s\n", c)
+	}
+	for _, f := range m.Frames {
+		fmt.Fprintf(bw, "|%d|", f.Commands)
+		for _, pad := range f.Pads {
+			for j := range len(fm2Buttons) {
+				if pad&(1<<(7-j)) != 0 {
+					bw.WriteByte(fm2Buttons[j])
+				} else {
+					bw.WriteByte('.')
+				}
+			}
+			bw.WriteByte('|')
+		}
+		bw.WriteString("|\n")
+	}
+	return bw.Flush()
+}
+
+// PlayMovie starts playing back m from power-on.
+func (g *Game) PlayMovie(m *Movie) {
+	if m.ROMChecksum != romMD5(g.cart) {
+		// FCEUX only warns too; a movie may still sync on a different dump.
+		slog.Warn("movie was recorded with a different ROM", "rom", m.ROMFilename)
+	}
+	g.startMovie(m, false)
+}
+
+// RecordMovie starts recording into m from power-on.
+func (g *Game) RecordMovie(m *Movie) {
+	g.startMovie(m, true)
+}
+
+// startMovie power cycles the console for a movie. Like in FCEUX, movies start
+// with cleared battery-backed RAM, so the .sav file is left alone while one is
+// active. The trainer is loaded again in case it lives in battery-backed RAM.
+func (g *Game) startMovie(m *Movie, recording bool) {
+	g.movie = m
+	g.movieRecording = recording
+	g.powerCycle()
+	clear(g.prgram[:g.sramSize])
+	g.loadTrainer()
+	g.sramPath = ""
+	g.sramDirty = false
+	g.frame = 0
+}
+
+// latchInput sets the controller state and runs the movie commands for the
+// next frame, from the movie being played back or from the keyboard and
+// gamepad. The frame number since power-on is the index into the movie, so
+// loading a state or rewinding while recording throws away the frames after it.
+// LoadState refuses states past the end of the movie, so i is never beyond it.
+func (g *Game) latchInput() {
+	i := int(g.frame)
+	if g.movie != nil && !g.movieRecording {
+		if i < len(g.movie.Frames) {
+			f := g.movie.Frames[i]
+			g.command, g.pads = f.Commands, f.Pads
+		} else {
+			slog.Info("movie finished", "frames", len(g.movie.Frames))
+			g.movie = nil
+		}
+	}
+	if g.movie == nil || g.movieRecording {
+		g.pads = [2]byte{}
+		for p, h := range g.inputHandlers {
+			for j, a := range nesBtns {
+				if h.ActionIsPressed(a) {
+					g.pads[p] |= 1 << j
+				}
+			}
+		}
+	}
+
+	if g.movie != nil && g.movieRecording {
+		if i < len(g.movie.Frames) {
+			g.movie.Rerecords++
+		}
+		f := MovieFrame{Commands: g.command, Pads: g.pads}
+		g.movie.Frames = append(g.movie.Frames[:min(i, len(g.movie.Frames))], f)
+	}
+
+	switch {
+	case g.command&CommandPower != 0:
+		g.powerCycle()
+	case g.command&CommandReset != 0:
+		g.reset()
+	}
+	g.command = 0
+}
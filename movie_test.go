@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFM2RoundTrip(t *testing.T) {
+	m := &Movie{
+		ROMFilename: "game.nes",
+		ROMChecksum: [16]byte{0: 0xde, 1: 0xad, 15: 0xff},
+		PAL:         true,
+		Rerecords:   42,
+		GUID:        "01234567-89AB-CDEF-0123-456789ABCDEF",
+		Comments:    []string{"author someone", "a comment"},
+		Frames: []MovieFrame{
+			{},
+			{Pads: [2]byte{0x81, 0}},
+			{Commands: CommandReset, Pads: [2]byte{0xff, 0x10}},
+			{Commands: CommandPower},
+		},
+	}
+	var buf bytes.Buffer
+	if err := m.WriteFM2(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFM2(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("ReadFM2(WriteFM2(m)) = %+v, want %+v", got, m)
+	}
+}
+
+func TestParseFM2Frame(t *testing.T) {
+	tests := []struct {
+		line  string
+		ports [2]bool
+		want  MovieFrame
+	}{
+		{"|0|........|........||", [2]bool{true, true}, MovieFrame{}},
+		{"|0|R......A|........||", [2]bool{true, true}, MovieFrame{Pads: [2]byte{0x81, 0}}},
+		{"|0|.L......|......B.||", [2]bool{true, true}, MovieFrame{Pads: [2]byte{0x40, 0x02}}},
+		{"|0|..DUTS..|........||", [2]bool{true, true}, MovieFrame{Pads: [2]byte{0x3c, 0}}},
+		// Any character but a space or a dot is a press.
+		{"|0|x      x|........||", [2]bool{true, true}, MovieFrame{Pads: [2]byte{0x81, 0}}},
+		{"|3|........|........||", [2]bool{true, true}, MovieFrame{Commands: CommandReset | CommandPower}},
+		// Ports without a gamepad have no field.
+		{"|0|R.......|||", [2]bool{true, false}, MovieFrame{Pads: [2]byte{0x80, 0}}},
+		{"|0||.......A||", [2]bool{false, true}, MovieFrame{Pads: [2]byte{0, 0x01}}},
+	}
+	for _, tt := range tests {
+		got, err := parseFM2Frame(tt.line, tt.ports)
+		if err != nil {
+			t.Errorf("parseFM2Frame(%q) error: %v", tt.line, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseFM2Frame(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestReadFM2Errors(t *testing.T) {
+	tests := []struct {
+		name, movie string
+	}{
+		{"version", "version 2\n"},
+		{"binary", "version 3\nbinary 1\n"},
+		{"save state", "version 3\nsavestate base64:AAAA\n"},
+		{"Four Score", "version 3\nfourscore 1\n"},
+		{"Zapper", "version 3\nport1 2\n"},
+		{"checksum", "version 3\nromChecksum base64:AAAA\n"},
+		{"rerecords", "version 3\nrerecordCount x\n"},
+		{"commands", "version 3\n|x|........|........||\n"},
+		{"short port", "version 3\n|0|.......|........||\n"},
+		{"missing port", "version 3\n|0|........\n"},
+	}
+	for _, tt := range tests {
+		if _, err := ReadFM2(strings.NewReader(tt.movie)); !errors.Is(err, ErrMovieFormat) {
+			t.Errorf("%s: ReadFM2() error = %v, want %v", tt.name, err, ErrMovieFormat)
+		}
+	}
+}
+
+func TestStartMovieKeepsTrainer(t *testing.T) {
+	for _, battery := range []bool{false, true} {
+		rom := testROM(0, 1, 1)
+		rom[6] |= 0x04 // Trainer
+		if battery {
+			rom[6] |= 0x02
+		}
+		trainer := bytes.Repeat([]byte{0xaa}, 512)
+		rom = append(rom[:16], append(trainer, rom[16:]...)...)
+		g, err := NewGame(rom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.prgram[0] = 0x55
+		g.RecordMovie(&Movie{})
+
+		if !bytes.Equal(g.prgram[0x1000:0x1200], trainer) {
+			t.Errorf("battery %t: trainer missing after starting a movie", battery)
+		}
+		if want := byte(0); battery && g.prgram[0] != want {
+			t.Errorf("battery %t: battery-backed RAM = %#02x after starting a movie, want %#02x", battery, g.prgram[0], want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	ntscWidth       = 602     // Output width for 256 input pixels, same as blargg's nes_ntsc
+	ntscLineSamples = 256 * 8 // The PPU outputs 8 signal samples per pixel
+	ntscPad         = 12      // Black samples around each scanline so filter windows don't need bounds checks
+)
+
+// NTSCPreset configures the NTSC filter.
+type NTSCPreset struct {
+	Name       string
+	Separate   bool    // Luma and chroma are carried separately (S-Video), so there is no fringing
+	Artifacts  float64 // How much chroma leaks into luma (dot crawl), 0..1
+	Bleed      int     // Chroma filter width in samples, 12 or more
+	Saturation float64 // Multiplied with the composite saturation
+	RGB        bool    // Bypass the signal entirely and just resample the palette colors
+}
+
+// ntscPresets are the NTSC filter presets, in the order they are cycled
+// through.
+var ntscPresets = []NTSCPreset{
+	{Name: "composite", Artifacts: 0.5, Bleed: 24, Saturation: 1},
+	{Name: "svideo", Separate: true, Bleed: 24, Saturation: 1},
+	{Name: "rgb", RGB: true},
+	{Name: "monochrome", Artifacts: 0.5, Bleed: 12, Saturation: 0},
+}
+
+// ntscPreset returns the index of the NTSC preset called name, or -1 for "off".
+func ntscPreset(name string) (int, error) {
+	if name == "" || strings.EqualFold(name, "off") {
+		return -1, nil
+	}
+	for i, p := range ntscPresets {
+		if strings.EqualFold(p.Name, name) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown NTSC filter preset %q", name)
+}
+
+// ntscFilter renders 9-bit NES pixels through a simulated NTSC composite video
+// signal, in the spirit of blargg's nes_ntsc. Each scanline is synthesized
+// from the 2C02's square wave output and decoded like a TV would, giving dot
+// crawl, color fringing and chroma bleed.
+type ntscFilter struct {
+	signal [512][12]float32 // Composite signal per color and phase
+	luma   [512]float32     // Average signal level per color (S-Video luma)
+	cos    [12]float64      // Chroma demodulation reference per phase
+	sin    [12]float64      //
+	gamma  [1025]byte       // Gamma correction of 0..1 in 1024 steps, math.Pow is too slow per pixel
+
+	// Prefix sums of the current scanline so that box filters take O(1).
+	sumY, sumL, sumI, sumQ []float64
+
+	out []byte // ntscWidth x 240 RGBA output
+}
+
+func newNTSCFilter() *ntscFilter {
+	f := &ntscFilter{
+		sumY: make([]float64, ntscLineSamples+2*ntscPad+1),
+		sumL: make([]float64, ntscLineSamples+2*ntscPad+1),
+		sumI: make([]float64, ntscLineSamples+2*ntscPad+1),
+		sumQ: make([]float64, ntscLineSamples+2*ntscPad+1),
+		out:  make([]byte, ntscWidth*240*4),
+	}
+	for c := range f.signal {
+		var sum float64
+		for phase := range 12 {
+			v := compositeSignal(uint16(c), phase)
+			f.signal[c][phase] = float32(v)
+			sum += v
+		}
+		f.luma[c] = float32(sum / 12)
+	}
+	for phase := range 12 {
+		angle := compositeAngle(phase, compositeParams)
+		f.cos[phase] = math.Cos(angle)
+		f.sin[phase] = math.Sin(angle)
+	}
+	for i := range f.gamma {
+		f.gamma[i] = byte(math.Round(255 * math.Pow(float64(i)/1024, 2.2/compositeParams.Gamma)))
+	}
+	return f
+}
+
+// render filters a 256x240 frame of 9-bit colors into f.out. frame is the
+// frame number, which determines the subcarrier phase (dot crawl).
+func (f *ntscFilter) render(pixels *[61440]uint16, palette *Palette, preset NTSCPreset, frame uint64) {
+	params := compositeParams
+	saturation := params.Saturation * preset.Saturation
+
+	// Each scanline is 341*8 samples long, which leaves the subcarrier 4
+	// phases further along at the start of every line. Frames alternate
+	// between two phases because of the odd-frame dot skip.
+	framePhase := int(frame%2) * 4
+
+	for y := range 240 {
+		line := pixels[y*256 : y*256+256]
+		out := f.out[y*ntscWidth*4 : (y+1)*ntscWidth*4]
+
+		if preset.RGB {
+			for x := range ntscWidth {
+				copy(out[x*4:x*4+4], palette[line[x*256/ntscWidth]][:])
+			}
+			continue
+		}
+
+		linePhase := (framePhase + y*4) % 12
+		f.sumLine(line, linePhase, preset.Separate)
+
+		for x := range ntscWidth {
+			// Sample at the center of the output pixel.
+			c := ntscPad + (2*x+1)*ntscLineSamples/(2*ntscWidth)
+
+			// A 12-sample window covers exactly one subcarrier cycle, so it
+			// removes chroma from luma completely. A narrow window lets some
+			// of it through, which shows up as dot crawl.
+			var luma float64
+			if preset.Separate {
+				luma = box(f.sumL, c, 4)
+			} else {
+				clean := box(f.sumY, c, 12)
+				luma = clean + preset.Artifacts*(box(f.sumY, c, 4)-clean)
+			}
+
+			// Demodulating the full composite signal picks up luma edges
+			// as false color (fringing).
+			i := box(f.sumI, c, preset.Bleed)
+			q := box(f.sumQ, c, preset.Bleed)
+
+			luma = luma*params.Contrast + params.Brightness
+			i *= saturation
+			q *= saturation
+			out[x*4+0] = f.gammaCorrect(luma + 0.946882*i + 0.623557*q)
+			out[x*4+1] = f.gammaCorrect(luma - 0.274788*i - 0.635691*q)
+			out[x*4+2] = f.gammaCorrect(luma - 1.108545*i + 1.709007*q)
+			out[x*4+3] = 255
+		}
+	}
+}
+
+// sumLine synthesizes the signal of one scanline and computes the prefix sums
+// of luma and demodulated chroma. If separate is true, chroma is demodulated
+// from the signal with luma removed.
+func (f *ntscFilter) sumLine(line []uint16, linePhase int, separate bool) {
+	for k := range ntscLineSamples + 2*ntscPad {
+		var v, l float64
+		phase := (linePhase + k - ntscPad + 12*ntscPad) % 12
+		if s := k - ntscPad; s >= 0 && s < ntscLineSamples {
+			c := line[s/8]
+			v = float64(f.signal[c][phase])
+			l = float64(f.luma[c])
+		}
+		chroma := v
+		if separate {
+			chroma = v - l
+		}
+		f.sumY[k+1] = f.sumY[k] + v
+		f.sumL[k+1] = f.sumL[k] + l
+		f.sumI[k+1] = f.sumI[k] + chroma*f.cos[phase]
+		f.sumQ[k+1] = f.sumQ[k] + chroma*f.sin[phase]
+	}
+}
+
+func (f *ntscFilter) gammaCorrect(v float64) byte {
+	return f.gamma[int(1024*max(0, min(1, v)))]
+}
+
+// box returns the average of the n samples centered on c, given their prefix
+// sums.
+func box(sum []float64, c, n int) float64 {
+	lo := max(0, c-n/2)
+	hi := min(len(sum)-1, lo+n)
+	return (sum[hi] - sum[lo]) / float64(n)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// namedPalette is a palette that can be selected with -palette or cycled
+// through at runtime.
+type namedPalette struct {
+	name    string
+	palette *Palette
+}
+
+// builtinPalettes are the built-in palettes, in the order they are cycled
+// through.
+var builtinPalettes = []namedPalette{
+	{"default", withEmphasis(paletteNTSC)},
+	{"2c03", withEmphasis(palette2C03)},
+	{"composite", GeneratePalette(DefaultPaletteParams)},
+}
+
+// setCompositeParams sets the parameters of the composite palette and NTSC
+// filter and regenerates the built-in composite palette.
+func setCompositeParams(params PaletteParams) {
+	compositeParams = params
+	for i, p := range builtinPalettes {
+		if p.name == "composite" {
+			builtinPalettes[i].palette = GeneratePalette(params)
+		}
+	}
+}
+
+// parsePalette parses a .pal file. 192-byte files contain the 64 base colors
+// and get emphasis applied automatically, 1536-byte files contain all 8
+// emphasis combinations.
+func parsePalette(b []byte) (*Palette, error) {
+	switch len(b) {
+	case 64 * 3:
+		base := make([][]byte, 64)
+		for i := range base {
+			base[i] = []byte{b[i*3], b[i*3+1], b[i*3+2], 255}
+		}
+		return withEmphasis(base), nil
+	case 512 * 3:
+		var p Palette
+		for i := range p {
+			p[i] = [4]byte{b[i*3], b[i*3+1], b[i*3+2], 255}
+		}
+		return &p, nil
+	default:
+		return nil, fmt.Errorf("invalid palette file size %d, expected %d or %d bytes", len(b), 64*3, 512*3)
+	}
+}
+
+// loadPalette returns the built-in palette called name, or loads the .pal file
+// at path name.
+func loadPalette(name string) (namedPalette, error) {
+	for _, p := range builtinPalettes {
+		if strings.EqualFold(p.name, name) {
+			return p, nil
+		}
+	}
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return namedPalette{}, err
+	}
+	p, err := parsePalette(b)
+	if err != nil {
+		return namedPalette{}, fmt.Errorf("%s: %w", name, err)
+	}
+	return namedPalette{name, p}, nil
+}
+
+// setPalettes sets the palettes to cycle through and selects the first one.
+func (g *Game) setPalettes(palettes []namedPalette) {
+	g.palettes = palettes
+	g.paletteIndex = 0
+	g.palette = palettes[0].palette
+}
+
+// cyclePalette switches to the next palette.
+func (g *Game) cyclePalette() {
+	g.paletteIndex = (g.paletteIndex + 1) % len(g.palettes)
+	g.palette = g.palettes[g.paletteIndex].palette
+	g.renderFrame()
+}
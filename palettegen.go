@@ -0,0 +1,122 @@
+package main
+
+import "math"
+
+// PaletteParams are the knobs of the composite palette generator.
+type PaletteParams struct {
+	Hue        float64 // Hue rotation in degrees
+	Saturation float64 // Chroma gain, 1 is unchanged
+	Contrast   float64 // Luma gain, 1 is unchanged
+	Brightness float64 // Luma offset, 0 is unchanged
+	Gamma      float64 // Gamma of the signal, corrected to the display's 2.2
+}
+
+// DefaultPaletteParams give colors close to a typical TV.
+var DefaultPaletteParams = PaletteParams{
+	Hue:        0,
+	Saturation: 1,
+	Contrast:   1,
+	Brightness: 0,
+	Gamma:      2.2,
+}
+
+// 2C02 output voltages for the low and high halves of the square wave at each
+// luma level, and the voltages of black ($0F) and white ($20).
+var (
+	compositeLow  = [4]float64{0.228, 0.312, 0.552, 0.880}
+	compositeHigh = [4]float64{0.616, 0.840, 1.100, 1.100}
+)
+
+const (
+	compositeBlack       = 0.312
+	compositeWhite       = 1.100
+	compositeAttenuation = 0.746 // Voltage multiplier for emphasized phases
+)
+
+// compositeParams are the parameters used for the built-in composite palette
+// and the NTSC filter.
+var compositeParams = DefaultPaletteParams
+
+// inPhase reports whether the 2C02's color generator output for color is high
+// at phase. The generator outputs a square wave with 12 phases per color
+// subcarrier cycle, color n is high for 6 phases starting at phase n.
+func inPhase(color, phase int) bool {
+	return (color+phase)%12 < 6
+}
+
+// compositeSignal returns the 2C02's composite output for the 9-bit color at
+// phase (0..11), normalized so that black is 0 and white is 1.
+func compositeSignal(c uint16, phase int) float64 {
+	color, level, emphasis := int(c&0x0f), c>>4&3, c>>6
+
+	low, high := compositeLow[level], compositeHigh[level]
+	switch {
+	case color == 0:
+		low = high
+	case color == 0x0d:
+		high = low
+	case color > 0x0d:
+		low, high = compositeBlack, compositeBlack
+	}
+
+	v := low
+	if inPhase(color, phase) {
+		v = high
+	}
+	// Emphasis attenuates the signal during the phases of colors $C (red),
+	// $4 (green) and $8 (blue). Columns $E and $F output black regardless.
+	if color < 0x0e && (emphasis&1 != 0 && inPhase(0x0c, phase) ||
+		emphasis&2 != 0 && inPhase(0x04, phase) ||
+		emphasis&4 != 0 && inPhase(0x08, phase)) {
+		v *= compositeAttenuation
+	}
+	return (v - compositeBlack) / (compositeWhite - compositeBlack)
+}
+
+// compositeAngle returns the angle of the TV's color subcarrier reference at
+// phase. The reference is offset by 3.5 phases to line up with the colorburst.
+func compositeAngle(phase int, params PaletteParams) float64 {
+	return math.Pi * (float64(phase) + 3.5 + params.Hue/30) / 6
+}
+
+// yiqToRGB converts a demodulated signal to gamma-corrected RGB.
+func yiqToRGB(y, i, q float64, params PaletteParams) [3]byte {
+	y = y*params.Contrast + params.Brightness
+	i *= params.Saturation
+	q *= params.Saturation
+
+	rgb := [3]float64{
+		y + 0.946882*i + 0.623557*q,
+		y - 0.274788*i - 0.635691*q,
+		y - 1.108545*i + 1.709007*q,
+	}
+	var out [3]byte
+	for ch, v := range rgb {
+		if v > 0 {
+			v = math.Pow(v, 2.2/params.Gamma)
+		}
+		out[ch] = byte(math.Round(255 * max(0, min(1, v))))
+	}
+	return out
+}
+
+// GeneratePalette computes all 512 NES colors by synthesizing the 2C02's
+// composite signal for each color and decoding it like an ideal NTSC TV.
+func GeneratePalette(params PaletteParams) *Palette {
+	var p Palette
+	for c := range p {
+		// Sample the signal over one subcarrier cycle and demodulate it into
+		// YIQ.
+		var y, i, q float64
+		for phase := range 12 {
+			v := compositeSignal(uint16(c), phase)
+			angle := compositeAngle(phase, params)
+			y += v
+			i += v * math.Cos(angle)
+			q += v * math.Sin(angle)
+		}
+		rgb := yiqToRGB(y/12, i/12, q/12, params)
+		p[c] = [4]byte{rgb[0], rgb[1], rgb[2], 255}
+	}
+	return &p
+}
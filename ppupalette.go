@@ -69,3 +69,51 @@ var paletteNTSC = [][]byte{
 	{0, 0, 0, 255},
 	{0, 0, 0, 255},
 }
+
+// palette2C03 is the palette of the RGB PPUs (2C03, 2C05) used in arcade
+// machines and the Famicom Titler. Each channel has 8 levels.
+var palette2C03 = rgb333([]uint16{
+	0333, 0014, 0006, 0326, 0403, 0503, 0510, 0420, 0320, 0120, 0031, 0040, 0022, 0000, 0000, 0000,
+	0555, 0036, 0027, 0407, 0507, 0704, 0700, 0630, 0430, 0140, 0040, 0053, 0044, 0000, 0000, 0000,
+	0777, 0357, 0447, 0637, 0707, 0737, 0740, 0750, 0660, 0360, 0070, 0276, 0077, 0000, 0000, 0000,
+	0777, 0567, 0657, 0757, 0747, 0755, 0764, 0772, 0773, 0572, 0473, 0276, 0467, 0000, 0000, 0000,
+})
+
+// rgb333 converts colors with 3 bits per channel, written as octal 0RGB, to
+// RGBA.
+func rgb333(colors []uint16) [][]byte {
+	out := make([][]byte, len(colors))
+	for i, c := range colors {
+		out[i] = []byte{byte(c >> 6 & 7 * 255 / 7), byte(c >> 3 & 7 * 255 / 7), byte(c & 7 * 255 / 7), 255}
+	}
+	return out
+}
+
+// Palette maps 9-bit NES colors (emphasis bits 8..6, color index 5..0) to RGBA.
+type Palette [512][4]byte
+
+// emphasisFactor is how much each emphasis bit attenuates the other two
+// channels.
+const emphasisFactor = 0.816
+
+// withEmphasis builds a full palette from 64 base colors by attenuating the
+// channels that aren't emphasized. Bit 6 emphasizes red, bit 7 green and bit 8
+// blue.
+func withEmphasis(base [][]byte) *Palette {
+	var p Palette
+	for i := range p {
+		c := base[i&63]
+		emphasis := i >> 6
+		for ch := range 3 {
+			v := float64(c[ch])
+			// Each channel is attenuated if any of the other channels is
+			// emphasized.
+			if emphasis&^(1<<ch) != 0 {
+				v *= emphasisFactor
+			}
+			p[i][ch] = byte(v)
+		}
+		p[i][3] = c[3]
+	}
+	return &p
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/MatusOllah/smolnes-go/ines"
+)
+
+// Region describes the timing differences between NES variants.
+type Region struct {
+	Name string
+
+	CPUClock  float64 // CPU clock rate in Hz
+	FrameRate float64 // Frames per second
+
+	// Exact frames per second as the fraction FrameRateNum/FrameRateDen,
+	// derived from the master clock and the average dots per frame.
+	FrameRateNum, FrameRateDen uint32
+
+	Scanlines   uint16 // Scanlines per frame, including the pre-render scanline
+	VBlankLine  uint16 // Scanline on which vblank starts
+	DotsPerCPU  int    // PPU dots per CPU cycle, as the fraction DotsPerCPU/CPUPerDots
+	CPUPerDots  int    //
+	OddFrameDot bool   // true if odd frames skip a dot when rendering is enabled
+
+	SwapEmphasis bool // true if the red and green emphasis bits are swapped
+
+	// APU rate tables in CPU cycles.
+	NoisePeriods [16]uint16
+	DMCRates     [16]uint16
+}
+
+// preRenderLine returns the pre-render scanline, which is the last one.
+func (r *Region) preRenderLine() uint16 {
+	return r.Scanlines - 1
+}
+
+var (
+	ntscNoisePeriods = [16]uint16{4, 8, 16, 32, 64, 96, 128, 160, 202, 254, 380, 508, 762, 1016, 2034, 4068}
+	ntscDMCRates     = [16]uint16{428, 380, 340, 320, 286, 254, 226, 214, 190, 160, 142, 128, 106, 84, 72, 54}
+)
+
+var (
+	RegionNTSC = &Region{
+		Name:         "NTSC",
+		CPUClock:     236.25e6 / 11 / 12,
+		FrameRate:    60.0988,
+		FrameRateNum: 39375000, // 236.25 MHz / 11 / 4 / 89341.5 dots
+		FrameRateDen: 655171,
+		Scanlines:    262,
+		VBlankLine:   241,
+		DotsPerCPU:   3,
+		CPUPerDots:   1,
+		OddFrameDot:  true,
+		NoisePeriods: ntscNoisePeriods,
+		DMCRates:     ntscDMCRates,
+	}
+
+	RegionPAL = &Region{
+		Name:         "PAL",
+		CPUClock:     26.601712e6 / 16,
+		FrameRate:    50.0070,
+		FrameRateNum: 3325214, // 26.601712 MHz / 5 / 106392 dots
+		FrameRateDen: 66495,
+		Scanlines:    312,
+		VBlankLine:   241,
+		DotsPerCPU:   16,
+		CPUPerDots:   5,
+		SwapEmphasis: true,
+		NoisePeriods: [16]uint16{4, 8, 14, 30, 60, 88, 118, 148, 188, 236, 354, 472, 708, 944, 1890, 3778},
+		DMCRates:     [16]uint16{398, 354, 316, 298, 276, 236, 210, 198, 176, 148, 132, 118, 98, 78, 66, 50},
+	}
+
+	// Dendy is a Famiclone with PAL frame timing but an NTSC-like CPU to PPU
+	// ratio. It delays vblank by 50 scanlines so that NTSC games, which expect
+	// a short vblank, still work. Its PPU swaps the red and green emphasis
+	// bits like the PAL 2C07.
+	RegionDendy = &Region{
+		Name:         "Dendy",
+		CPUClock:     26.601712e6 / 15,
+		FrameRate:    50.0070,
+		FrameRateNum: 3325214,
+		FrameRateDen: 66495,
+		Scanlines:    312,
+		VBlankLine:   291,
+		DotsPerCPU:   3,
+		CPUPerDots:   1,
+		SwapEmphasis: true,
+		NoisePeriods: ntscNoisePeriods,
+		DMCRates:     ntscDMCRates,
+	}
+)
+
+// regionForTiming returns the region for the timing mode in the ROM header.
+func regionForTiming(t ines.Timing) *Region {
+	switch t {
+	case ines.TimingPAL:
+		return RegionPAL
+	case ines.TimingDendy:
+		return RegionDendy
+	default:
+		return RegionNTSC
+	}
+}
+
+// parseRegion returns the region called name, or nil for "auto".
+func parseRegion(name string) (*Region, error) {
+	switch strings.ToLower(name) {
+	case "", "auto":
+		return nil, nil
+	case "ntsc":
+		return RegionNTSC, nil
+	case "pal":
+		return RegionPAL, nil
+	case "dendy":
+		return RegionDendy, nil
+	default:
+		return nil, fmt.Errorf("invalid region: \"%s\"; should be one of \"auto\", \"ntsc\", \"pal\", \"dendy\"", name)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// rewindBuffer is a ring buffer of save states, one per frame. Only the newest
+// state is kept in full. Every older state is stored as the deflated XOR with
+// the state after it, which is mostly zeros since little changes from frame to
+// frame.
+type rewindBuffer struct {
+	deltas [][]byte // Ring buffer of compressed deltas, oldest at start
+	start  int      // Index of the oldest delta
+	count  int      // Number of deltas in the ring
+	latest []byte   // Newest state in full, nil if the buffer is empty
+
+	xor []byte
+	buf bytes.Buffer
+	fw  *flate.Writer
+	fr  io.ReadCloser
+}
+
+// newRewindBuffer returns a rewind buffer that can go back frames frames.
+func newRewindBuffer(frames int) *rewindBuffer {
+	fw, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return &rewindBuffer{
+		deltas: make([][]byte, frames),
+		fw:     fw,
+		fr:     flate.NewReader(nil),
+	}
+}
+
+// push adds a state as the newest one, evicting the oldest if the buffer is
+// full.
+func (r *rewindBuffer) push(state []byte) {
+	if r.latest == nil || len(r.latest) != len(state) {
+		r.start, r.count = 0, 0
+		r.latest = bytes.Clone(state)
+		return
+	}
+
+	r.xor = r.xor[:0]
+	for i, b := range state {
+		r.xor = append(r.xor, r.latest[i]^b)
+	}
+	r.buf.Reset()
+	r.fw.Reset(&r.buf)
+	r.fw.Write(r.xor)
+	r.fw.Close()
+
+	i := (r.start + r.count) % len(r.deltas)
+	if r.count == len(r.deltas) {
+		r.start = (r.start + 1) % len(r.deltas)
+	} else {
+		r.count++
+	}
+	r.deltas[i] = append(r.deltas[i][:0], r.buf.Bytes()...)
+	copy(r.latest, state)
+}
+
+// pop drops the newest state and returns the one before it, which becomes the
+// newest. It returns nil if there is no older state. The returned slice is only
+// valid until the next call to push or pop.
+func (r *rewindBuffer) pop() ([]byte, error) {
+	if r.count == 0 {
+		return nil, nil
+	}
+
+	r.count--
+	delta := r.deltas[(r.start+r.count)%len(r.deltas)]
+	r.fr.(flate.Resetter).Reset(bytes.NewReader(delta), nil)
+	r.xor = r.xor[:len(r.latest)]
+	if _, err := io.ReadFull(r.fr, r.xor); err != nil {
+		return nil, fmt.Errorf("failed to decompress rewind state: %w", err)
+	}
+	for i, b := range r.xor {
+		r.latest[i] ^= b
+	}
+	return r.latest, nil
+}
+
+// reset drops all states.
+func (r *rewindBuffer) reset() {
+	r.start, r.count = 0, 0
+	r.latest = nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"testing"
+)
+
+// rewindStates returns n random states of the same size, each differing from
+// the one before it in a few bytes, like consecutive frames.
+func rewindStates(n int) [][]byte {
+	rng := rand.New(rand.NewPCG(1, 2))
+	states := make([][]byte, n)
+	state := make([]byte, 4096)
+	for i := range state {
+		state[i] = byte(rng.Uint32())
+	}
+	for i := range states {
+		for range 16 {
+			state[rng.IntN(len(state))] = byte(rng.Uint32())
+		}
+		states[i] = bytes.Clone(state)
+	}
+	return states
+}
+
+func TestRewindPop(t *testing.T) {
+	states := rewindStates(10)
+	r := newRewindBuffer(len(states))
+	for _, s := range states {
+		r.push(s)
+	}
+	for i := len(states) - 2; i >= 0; i-- {
+		got, err := r.pop()
+		if err != nil {
+			t.Fatalf("pop() error = %v", err)
+		}
+		if !bytes.Equal(got, states[i]) {
+			t.Fatalf("pop() = state %d differs", i)
+		}
+	}
+	if got, err := r.pop(); got != nil || err != nil {
+		t.Errorf("pop() on the oldest state = %v, %v, want nil, nil", got, err)
+	}
+}
+
+func TestRewindEviction(t *testing.T) {
+	const frames = 4
+	states := rewindStates(10)
+	r := newRewindBuffer(frames)
+	for _, s := range states {
+		r.push(s)
+	}
+	// Only the newest state and the frames before it are kept.
+	for i := len(states) - 2; i >= len(states)-1-frames; i-- {
+		got, err := r.pop()
+		if err != nil {
+			t.Fatalf("pop() error = %v", err)
+		}
+		if !bytes.Equal(got, states[i]) {
+			t.Fatalf("pop() = state %d differs", i)
+		}
+	}
+	if got, err := r.pop(); got != nil || err != nil {
+		t.Errorf("pop() past the evicted states = %v, %v, want nil, nil", got, err)
+	}
+
+	// Pushing after popping overwrites the popped states.
+	r.push(states[0])
+	got, err := r.pop()
+	if err != nil {
+		t.Fatalf("pop() error = %v", err)
+	}
+	if !bytes.Equal(got, states[len(states)-1-frames]) {
+		t.Error("pop() after push didn't return the state before it")
+	}
+}
+
+func TestRewindCorrupt(t *testing.T) {
+	states := rewindStates(3)
+	r := newRewindBuffer(len(states))
+	for _, s := range states {
+		r.push(s)
+	}
+	r.deltas[(r.start+r.count-1)%len(r.deltas)] = []byte{0xff}
+	if _, err := r.pop(); err == nil {
+		t.Error("pop() of a corrupt delta succeeded")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/MatusOllah/smolnes-go/ines"
+)
+
+// Save states start with a header of stateMagic, the format version, the
+// SHA-1 of the ROM and the length-prefixed region name, followed by the Game
+// fields in the order of (*Game).serialize. Bump stateVersion whenever that
+// order changes.
+const (
+	stateMagic   = "NESSTATE"
+	stateVersion = 3
+)
+
+var (
+	// ErrStateFormat is returned when a file isn't a save state or is corrupt.
+	ErrStateFormat = errors.New("not a valid save state")
+
+	// ErrStateVersion is returned when a save state was written by an
+	// incompatible version of the emulator.
+	ErrStateVersion = errors.New("unsupported save state version")
+
+	// ErrStateROM is returned when a save state belongs to a different ROM.
+	ErrStateROM = errors.New("save state is for a different ROM")
+
+	// ErrStateRegion is returned when a save state was made with a different
+	// region, whose timing the PPU state doesn't match.
+	ErrStateRegion = errors.New("save state is for a different region")
+
+	// ErrStateMovie is returned when a save state is past the end of the
+	// movie being recorded, which has no input for the frames in between.
+	ErrStateMovie = errors.New("save state is past the end of the movie")
+)
+
+// stateCodec reads or writes the fields of a save state in order, so that
+// (*Game).serialize describes the format once for both directions.
+type stateCodec struct {
+	buf     []byte // Encoded state; appended to when saving, consumed when loading
+	loading bool
+	err     error
+	scratch [8]byte
+}
+
+func (s *stateCodec) bytes(b []byte) {
+	if !s.loading {
+		s.buf = append(s.buf, b...)
+		return
+	}
+	if s.err != nil {
+		return
+	}
+	if len(s.buf) < len(b) {
+		s.err = fmt.Errorf("%w: truncated", ErrStateFormat)
+		return
+	}
+	copy(b, s.buf)
+	s.buf = s.buf[len(b):]
+}
+
+func (s *stateCodec) u8(v *byte) {
+	s.scratch[0] = *v
+	s.bytes(s.scratch[:1])
+	*v = s.scratch[0]
+}
+
+func (s *stateCodec) boolean(v *bool) {
+	b := bool2byte(*v)
+	s.u8(&b)
+	*v = b != 0
+}
+
+func (s *stateCodec) u16(v *uint16) {
+	binary.LittleEndian.PutUint16(s.scratch[:], *v)
+	s.bytes(s.scratch[:2])
+	*v = binary.LittleEndian.Uint16(s.scratch[:])
+}
+
+func (s *stateCodec) u16s(v []uint16) {
+	for i := range v {
+		s.u16(&v[i])
+	}
+}
+
+func (s *stateCodec) u64(v *uint64) {
+	binary.LittleEndian.PutUint64(s.scratch[:], *v)
+	s.bytes(s.scratch[:8])
+	*v = binary.LittleEndian.Uint64(s.scratch[:])
+}
+
+func (s *stateCodec) int(v *int) {
+	u := uint64(*v)
+	s.u64(&u)
+	*v = int(u)
+}
+
+// serialize reads or writes every field that affects emulation. Memory sizes
+// depend only on the ROM, which the header pins down.
+func (g *Game) serialize(s *stateCodec) {
+	// CPU
+	for _, r := range []*byte{&g.a, &g.x, &g.y, &g.p, &g.s, &g.pch, &g.pcl, &g.addrLo, &g.addrHi, &g.nomem, &g.result, &g.val, &g.cross, &g.tmp, &g.opcode, &g.nmiIRQ} {
+		s.u8(r)
+	}
+	s.u16(&g.sum)
+	s.u16(&g.cycles)
+	s.bytes(g.ram[:])
+	s.bytes(g.keys[:])
+
+	// PPU
+	for _, r := range []*byte{&g.ppumask, &g.ppuctrl, &g.ppustatus, &g.ppubuf, &g.ppuOpenBus, &g.fineX, &g.ntb, &g.ptbLo, &g.oamaddr} {
+		s.u8(r)
+	}
+	s.boolean(&g.w)
+	for _, r := range []*uint16{&g.t, &g.v, &g.scany, &g.dot, &g.atb, &g.shiftHi, &g.shiftLo} {
+		s.u16(r)
+	}
+	s.int(&g.shiftAt)
+	s.int(&g.dotsFrac)
+	s.boolean(&g.oddFrame)
+	s.boolean(&g.vblSuppress)
+	s.u64(&g.frame)
+	s.bytes(g.vram[:])
+	s.bytes(g.paletteram[:])
+	s.bytes(g.oam[:])
+	s.int(&g.spriteCount)
+	s.bytes(g.spriteX[:])
+	s.bytes(g.spriteAttr[:])
+	s.bytes(g.spritePatLo[:])
+	s.bytes(g.spritePatHi[:])
+	s.boolean(&g.sprite0Line)
+	s.u16s(g.pixels[:])
+
+	// Cartridge and mapper
+	s.bytes(g.prgram)
+	s.bytes(g.chrram)
+	s.bytes(g.prg[:])
+	s.bytes(g.chr[:])
+	s.u8(&g.prgbits)
+	s.u8(&g.chrbits)
+	s.u8((*byte)(&g.mirror))
+	for _, r := range []*byte{&g.mmc1Bits, &g.mmc1Data, &g.mmc1Ctrl, &g.mmc3Bits, &g.mmc3Irq, &g.mmc3Latch, &g.chrbank0, &g.chrbank1, &g.prgbank} {
+		s.u8(r)
+	}
+	s.bytes(g.mmc3Chrprg[:])
+
+	// There is no APU yet. Its state goes here once there is, with a version
+	// bump.
+}
+
+// SaveState returns a snapshot of the emulator state.
+func (g *Game) SaveState() []byte {
+	return g.SaveStateTo(make([]byte, 0, 160*1024))
+}
+
+// SaveStateTo is like SaveState, but reuses buf's storage if it is big enough.
+func (g *Game) SaveStateTo(buf []byte) []byte {
+	s := &stateCodec{buf: buf[:0]}
+	s.buf = append(s.buf, stateMagic...)
+	s.buf = binary.LittleEndian.AppendUint16(s.buf, stateVersion)
+	s.buf = append(s.buf, g.romHash[:]...)
+	s.buf = append(s.buf, byte(len(g.region.Name)))
+	s.buf = append(s.buf, g.region.Name...)
+	g.serialize(s)
+	return s.buf
+}
+
+// LoadState restores a snapshot made by SaveState. If b isn't a valid state for
+// this ROM, the emulator state is left unchanged.
+func (g *Game) LoadState(b []byte) error {
+	header := len(stateMagic) + 2 + len(g.romHash)
+	if len(b) < header || string(b[:len(stateMagic)]) != stateMagic {
+		return ErrStateFormat
+	}
+	if v := binary.LittleEndian.Uint16(b[len(stateMagic):]); v != stateVersion {
+		return fmt.Errorf("%w %d, expected %d", ErrStateVersion, v, stateVersion)
+	}
+	if !bytes.Equal(b[len(stateMagic)+2:header], g.romHash[:]) {
+		return ErrStateROM
+	}
+	if len(b) == header || len(b) < header+1+int(b[header]) {
+		return ErrStateFormat
+	}
+	if region := string(b[header+1 : header+1+int(b[header])]); region != g.region.Name {
+		return fmt.Errorf("%w: state is %s, console is %s", ErrStateRegion, region, g.region.Name)
+	}
+	header += 1 + int(b[header])
+
+	// Decode into a scratch console first, so that g is only touched once b
+	// is known to be good.
+	if g.loadScratch == nil {
+		g.loadScratch = &Game{
+			cart:   g.cart,
+			prgram: make([]byte, len(g.prgram)),
+			chrram: make([]byte, len(g.chrram)),
+		}
+	}
+	g.loadScratch.region = g.region
+	g.loadScratch.noSpriteLimit = g.noSpriteLimit
+	if err := g.loadScratch.decodeState(b[header:]); err != nil {
+		return err
+	}
+	if g.movie != nil && g.movieRecording && g.loadScratch.frame > uint64(len(g.movie.Frames)) {
+		return fmt.Errorf("%w: state is at frame %d, movie has %d", ErrStateMovie, g.loadScratch.frame, len(g.movie.Frames))
+	}
+
+	g.decodeState(b[header:])
+	g.setMirroring(g.mirror)
+	if g.sramSize != 0 {
+		g.sramDirty = true
+	}
+	return nil
+}
+
+// decodeState reads the Game fields from b and checks them. g is left half
+// decoded if that fails.
+func (g *Game) decodeState(b []byte) error {
+	s := &stateCodec{buf: b, loading: true}
+	g.serialize(s)
+	if s.err == nil && len(s.buf) != 0 {
+		s.err = fmt.Errorf("%w: %d bytes of trailing data", ErrStateFormat, len(s.buf))
+	}
+	if s.err == nil {
+		s.err = g.checkState()
+	}
+	return s.err
+}
+
+// checkState checks the decoded fields that index arrays or steer the PPU, so
+// that a corrupt state is rejected instead of crashing the emulator later. The
+// PRG and CHR bank registers need no check, since every access masks them with
+// the bank count.
+func (g *Game) checkState() error {
+	prgbits, chrbits := byte(14), byte(12)
+	if g.cart.Mapper == 4 {
+		prgbits, chrbits = 13, 10
+	}
+	maxSprites := 8
+	if g.noSpriteLimit {
+		maxSprites = len(g.spriteX)
+	}
+	switch {
+	case g.prgbits != prgbits || g.chrbits != chrbits:
+		return fmt.Errorf("%w: %d/%d-bit PRG/CHR banks, mapper %d uses %d/%d", ErrStateFormat, g.prgbits, g.chrbits, g.cart.Mapper, prgbits, chrbits)
+	case g.spriteCount < 0 || g.spriteCount > maxSprites:
+		return fmt.Errorf("%w: %d sprites on a scanline", ErrStateFormat, g.spriteCount)
+	case g.mirror > ines.SingleScreenB:
+		return fmt.Errorf("%w: mirroring mode %d", ErrStateFormat, g.mirror)
+	case g.scany >= g.region.Scanlines || g.dot > 340:
+		return fmt.Errorf("%w: PPU at scanline %d dot %d", ErrStateFormat, g.scany, g.dot)
+	case g.dotsFrac < 0 || g.dotsFrac >= g.region.CPUPerDots:
+		return fmt.Errorf("%w: %d/%d PPU dots carried over", ErrStateFormat, g.dotsFrac, g.region.CPUPerDots)
+	}
+	return nil
+}
+
+// SaveStateSlot writes a snapshot of the emulator state to a numbered slot.
+func (g *Game) SaveStateSlot(slot int) error {
+	if g.statePath == nil {
+		return errors.New("save states are disabled")
+	}
+	return writeFileAtomic(g.statePath(slot), g.SaveState())
+}
+
+// LoadStateSlot restores the snapshot in a numbered slot.
+func (g *Game) LoadStateSlot(slot int) error {
+	if g.statePath == nil {
+		return errors.New("save states are disabled")
+	}
+	b, err := os.ReadFile(g.statePath(slot))
+	if err != nil {
+		return err
+	}
+	return g.LoadState(b)
+}
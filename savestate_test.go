@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	for _, mapper := range []byte{0, 1, 4} {
+		a, err := NewGame(testROM(mapper, 2, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range a.ram {
+			a.ram[i] = byte(i * 7)
+		}
+		a.runFrame()
+		state := a.SaveState()
+
+		b, err := NewGame(testROM(mapper, 2, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.LoadState(state); err != nil {
+			t.Fatalf("mapper %d: LoadState() error = %v", mapper, err)
+		}
+		if !bytes.Equal(b.SaveState(), state) {
+			t.Errorf("mapper %d: state changed in a save/load round trip", mapper)
+		}
+		a.runFrame()
+		b.runFrame()
+		if a.pixels != b.pixels {
+			t.Errorf("mapper %d: frame after loading differs", mapper)
+		}
+	}
+}
+
+func TestLoadStateErrors(t *testing.T) {
+	g := testGame(t)
+	good := g.SaveState()
+	other, err := NewGame(testROM(2, 2, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pal, err := NewGame(testROM(0, 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pal.region = RegionPAL
+
+	// corrupt returns the state of g with f applied.
+	corrupt := func(f func(g *Game)) []byte {
+		c := *g
+		f(&c)
+		return c.SaveState()
+	}
+	version := bytes.Clone(good)
+	version[len(stateMagic)]++
+
+	tests := []struct {
+		name  string
+		state []byte
+		want  error
+	}{
+		{"empty", nil, ErrStateFormat},
+		{"bad magic", append([]byte("NOTSTATE"), good[8:]...), ErrStateFormat},
+		{"version", version, ErrStateVersion},
+		{"other ROM", other.SaveState(), ErrStateROM},
+		{"other region", pal.SaveState(), ErrStateRegion},
+		{"truncated", good[:len(good)-1], ErrStateFormat},
+		{"trailing data", append(bytes.Clone(good), 0), ErrStateFormat},
+		{"sprite count", corrupt(func(g *Game) { g.spriteCount = 9 }), ErrStateFormat},
+		{"negative sprite count", corrupt(func(g *Game) { g.spriteCount = -1 }), ErrStateFormat},
+		{"PRG bank size", corrupt(func(g *Game) { g.prgbits = 12 }), ErrStateFormat},
+		{"CHR bank size", corrupt(func(g *Game) { g.chrbits = 0 }), ErrStateFormat},
+		{"mirroring", corrupt(func(g *Game) { g.mirror = 0xff }), ErrStateFormat},
+		{"scanline", corrupt(func(g *Game) { g.scany = 262 }), ErrStateFormat},
+		{"dot", corrupt(func(g *Game) { g.dot = 341 }), ErrStateFormat},
+	}
+	for _, tt := range tests {
+		if err := g.LoadState(tt.state); !errors.Is(err, tt.want) {
+			t.Errorf("%s: LoadState() error = %v, want %v", tt.name, err, tt.want)
+		}
+		if !bytes.Equal(g.SaveState(), good) {
+			t.Fatalf("%s: failed LoadState() changed the state", tt.name)
+		}
+	}
+
+	// Bank registers are masked on access, so any value is valid.
+	state := corrupt(func(g *Game) {
+		g.prg = [4]byte{0xff, 0xff, 0xff, 0xff}
+		g.chr = [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	})
+	if err := g.LoadState(state); err != nil {
+		t.Fatalf("LoadState() with out of range banks: %v", err)
+	}
+	g.ppumask = 0x18
+	g.runFrame()
+}
+
+func TestNoSpriteLimitState(t *testing.T) {
+	g := testGame(t)
+	g.noSpriteLimit = true
+	g.spriteCount = 64
+	state := g.SaveState()
+	if err := g.LoadState(state); err != nil {
+		t.Errorf("LoadState() with 64 sprites and no sprite limit: %v", err)
+	}
+	g.noSpriteLimit = false
+	if err := g.LoadState(state); !errors.Is(err, ErrStateFormat) {
+		t.Errorf("LoadState() with 64 sprites and the sprite limit: error = %v, want %v", err, ErrStateFormat)
+	}
+}
+
+func TestSaveStateToReusesBuffer(t *testing.T) {
+	g := testGame(t)
+	buf := g.SaveState()
+	if n := testing.AllocsPerRun(10, func() { buf = g.SaveStateTo(buf) }); n != 0 {
+		t.Errorf("SaveStateTo() allocates %v times with a big enough buffer, want 0", n)
+	}
+	if !bytes.Equal(buf, g.SaveState()) {
+		t.Error("SaveStateTo() and SaveState() differ")
+	}
+}
+
+func TestLoadStateWhileRecording(t *testing.T) {
+	g, err := NewGame(testROM(0, 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.RecordMovie(&Movie{})
+	g.runFrame()
+	early := g.SaveState()
+	for range 4 {
+		g.runFrame()
+	}
+	late := g.SaveState()
+
+	if err := g.LoadState(early); err != nil {
+		t.Fatalf("LoadState() of an earlier frame: %v", err)
+	}
+	g.runFrame()
+	if len(g.movie.Frames) != 2 {
+		t.Errorf("movie has %d frames after loading frame 1 and running one, want 2", len(g.movie.Frames))
+	}
+	if err := g.LoadState(late); !errors.Is(err, ErrStateMovie) {
+		t.Errorf("LoadState() past the end of the movie: error = %v, want %v", err, ErrStateMovie)
+	}
+	if g.frame != 2 {
+		t.Errorf("frame = %d after a refused LoadState(), want 2", g.frame)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"path/filepath"
+	"time"
+)
+
+// Frame returns the last finished frame, cropped by the overscan settings. The
+// image is a copy and stays valid while the emulator keeps running.
+func (g *Game) Frame() image.Image {
+	src := &image.RGBA{Pix: g.frameBuffer, Stride: 256 * 4, Rect: image.Rect(0, 0, 256, 240)}
+	r := g.frameRect()
+	img := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	for y := range r.Dy() {
+		copy(img.Pix[y*img.Stride:], src.Pix[src.PixOffset(r.Min.X, r.Min.Y+y):src.PixOffset(r.Max.X, r.Min.Y+y)])
+	}
+	return img
+}
+
+// scaleImage scales img up by an integer factor with nearest neighbor
+// sampling.
+func scaleImage(img *image.RGBA, scale int) *image.RGBA {
+	if scale <= 1 {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx()*scale, b.Dy()*scale))
+	for y := range dst.Rect.Dy() {
+		for x := range dst.Rect.Dx() {
+			i := img.PixOffset(x/scale, y/scale)
+			copy(dst.Pix[dst.PixOffset(x, y):], img.Pix[i:i+4])
+		}
+	}
+	return dst
+}
+
+// SaveScreenshot writes the last finished frame, scaled up by scale, to a
+// timestamped PNG file in dir and returns its path.
+func (g *Game) SaveScreenshot(dir string, scale int) (string, error) {
+	img := scaleImage(g.Frame().(*image.RGBA), scale)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s-%s.png", g.romName, time.Now().Format("20060102-150405.000"))
+	path := filepath.Join(dir, name)
+	return path, writeFileAtomic(path, buf.Bytes())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"os"
+	"testing"
+)
+
+// fillFrame fills the frame buffer with a color unique to each pixel.
+func fillFrame(g *Game) {
+	for y := range 240 {
+		for x := range 256 {
+			i := (y*256 + x) * 4
+			g.frameBuffer[i], g.frameBuffer[i+1], g.frameBuffer[i+2], g.frameBuffer[i+3] = byte(x), byte(y), byte(x^y), 0xff
+		}
+	}
+}
+
+// sameImage reports whether a and b have the same size and pixels.
+func sameImage(a, b image.Image) bool {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return false
+	}
+	ab, bb := a.Bounds(), b.Bounds()
+	for y := range ab.Dy() {
+		for x := range ab.Dx() {
+			r1, g1, b1, a1 := a.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+			r2, g2, b2, a2 := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestFrameOverscan(t *testing.T) {
+	g := testGame(t)
+	g.overscan = Overscan{Top: 3, Bottom: 5, Left: 7, Right: 11}
+	fillFrame(g)
+	img := g.Frame().(*image.RGBA)
+	r := g.frameRect()
+	if img.Bounds().Size() != r.Size() {
+		t.Fatalf("Frame() size = %v, want %v", img.Bounds().Size(), r.Size())
+	}
+	for y := range r.Dy() {
+		for x := range r.Dx() {
+			// fillFrame stores the source position in R and G.
+			if c := img.RGBAAt(x, y); c.R != byte(r.Min.X+x) || c.G != byte(r.Min.Y+y) {
+				t.Fatalf("Frame() pixel (%d, %d) is from (%d, %d), want (%d, %d)", x, y, c.R, c.G, r.Min.X+x, r.Min.Y+y)
+			}
+		}
+	}
+}
+
+func TestScaleImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i := range src.Pix {
+		src.Pix[i] = byte(i)
+	}
+	for _, n := range []int{1, 2, 3} {
+		dst := scaleImage(src, n)
+		if dst.Bounds() != image.Rect(0, 0, 3*n, 2*n) {
+			t.Fatalf("scaleImage(%d) bounds = %v", n, dst.Bounds())
+		}
+		for y := range 2 * n {
+			for x := range 3 * n {
+				if dst.RGBAAt(x, y) != src.RGBAAt(x/n, y/n) {
+					t.Fatalf("scaleImage(%d) pixel (%d, %d) = %v, want %v", n, x, y, dst.RGBAAt(x, y), src.RGBAAt(x/n, y/n))
+				}
+			}
+		}
+	}
+}
+
+func TestSaveScreenshot(t *testing.T) {
+	g := testGame(t)
+	g.romName = "test"
+	fillFrame(g)
+	path, err := g.SaveScreenshot(t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := scaleImage(g.Frame().(*image.RGBA), 2); !sameImage(img, want) {
+		t.Error("screenshot doesn't match the scaled frame")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+// Speed control keys. Fast-forward is held, slow motion and pause toggle.
+const (
+	keyFastForward  = ebiten.KeyBackquote
+	keySlowMotion   = ebiten.KeyF4
+	keyPause        = ebiten.KeyP
+	keyFrameAdvance = ebiten.KeyBackslash
+)
+
+// runFrames emulates as many frames as the current speed calls for in one
+// tick. Fractional speeds carry over to the next tick, so slow motion at 0.5
+// runs a frame every other tick.
+//
+// There is no APU yet. Once there is, audio should be dropped rather than
+// pitched up while fast-forwarding, and muted while paused or in slow motion,
+// so that the audio buffer never runs ahead of or behind real time.
+func (g *Game) runFrames() {
+	speed := 1.0
+	switch {
+	case ebiten.IsKeyPressed(keyFastForward) && g.fastForward == 0:
+		// Uncapped: run frames for most of the tick and leave the rest for
+		// drawing.
+		deadline := time.Now().Add(time.Second * 9 / time.Duration(10*ebiten.TPS()))
+		for time.Now().Before(deadline) {
+			g.runFrame()
+		}
+		g.speedAcc = 0
+		return
+	case ebiten.IsKeyPressed(keyFastForward):
+		speed = g.fastForward
+	case g.slowMotion:
+		speed = g.slowMotionSpeed
+	}
+	// Ticks run at the frame rate rounded to a whole number, so scale by the
+	// exact rate to keep the emulated speed right. NTSC runs an extra frame
+	// about every 10 seconds, PAL and Dendy about every 2 minutes.
+	speed *= float64(g.region.FrameRateNum) / float64(g.region.FrameRateDen) / float64(ebiten.TPS())
+
+	for g.speedAcc += speed; g.speedAcc >= 1; g.speedAcc-- {
+		g.runFrame()
+	}
+}
+
+// runFrame runs the CPU and PPU until the PPU finishes a frame.
+func (g *Game) runFrame() {
+	g.latchInput()
+
+	for g.frameDone = false; !g.frameDone; {
+		g.step()
+	}
+
+	if g.video != nil {
+		g.writeVideoFrame()
+	}
+	if g.gif != nil && g.frame%gifFrameStep == 0 {
+		g.gif.capture(&g.pixels, g.emphasis())
+	}
+	if g.rewind != nil {
+		g.rewindState = g.SaveStateTo(g.rewindState)
+		g.rewind.push(g.rewindState)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+// spriteHeight returns the sprite height in pixels, 8 or 16 depending on
+// PPUCTRL bit 5.
+func (g *Game) spriteHeight() uint16 {
+	if g.ppuctrl&32 != 0 {
+		return 16
+	}
+	return 8
+}
+
+// evaluateSprites finds the sprites on the next scanline, like the PPU does
+// during dots 65..256, and fetches their patterns, like it does during dots
+// 257..320.
+func (g *Game) evaluateSprites() {
+	h := g.spriteHeight()
+	inRange := func(y byte) bool {
+		return g.scany-uint16(y) < h
+	}
+
+	var found [64]byte
+	count := 0
+	n := 0
+	for ; n < 64 && count < 8; n++ {
+		if inRange(g.oam[n*4]) {
+			found[count] = byte(n)
+			count++
+		}
+	}
+
+	if count == 8 {
+		// The PPU keeps looking for a ninth sprite to set the overflow flag,
+		// but a hardware bug increments the byte offset along with the sprite
+		// index, so it compares tile, attribute and X bytes as if they were Y
+		// coordinates.
+		for m := 0; n < 64; n++ {
+			if inRange(g.oam[n*4+m]) {
+				g.ppustatus |= 32
+				break
+			}
+			m = (m + 1) & 3
+		}
+
+		if g.noSpriteLimit {
+			for n := int(found[7]) + 1; n < 64; n++ {
+				if inRange(g.oam[n*4]) {
+					found[count] = byte(n)
+					count++
+				}
+			}
+		}
+	}
+
+	g.spriteCount = count
+	g.sprite0Line = count > 0 && found[0] == 0
+	for i, n := range found[:count] {
+		y, tile, attr, x := g.oam[n*4], uint16(g.oam[n*4+1]), g.oam[n*4+2], g.oam[n*4+3]
+		row := g.scany - uint16(y)
+		if attr&128 != 0 { // Vertical flip
+			row ^= h - 1
+		}
+
+		var addr uint16
+		if h == 16 {
+			// 8x16 sprites
+			addr = tile%2<<12 | (tile&0xfe)<<4 | (row&8)*2 | row&7
+		} else {
+			// 8x8 sprites
+			addr = uint16(g.ppuctrl)&8<<9 | tile<<4 | row&7
+		}
+		lo, hi := *g.getCHRByte(addr), *g.getCHRByte(addr + 8)
+		if attr&64 != 0 { // Horizontal flip
+			lo, hi = reverseBits(lo), reverseBits(hi)
+		}
+
+		g.spriteX[i] = x
+		g.spriteAttr[i] = attr
+		g.spritePatLo[i] = lo
+		g.spritePatHi[i] = hi
+	}
+}
+
+// spritePixel returns the color and palette of the frontmost opaque sprite
+// pixel at the current dot. color is 0 if there is none. behind is true if the
+// sprite has background priority, zero is true if it is sprite 0.
+func (g *Game) spritePixel() (color, palette byte, behind, zero bool) {
+	for i := range g.spriteCount {
+		dx := g.dot - uint16(g.spriteX[i])
+		if dx >= 8 {
+			continue
+		}
+		color = g.spritePatHi[i]>>(7-dx)&1<<1 | g.spritePatLo[i]>>(7-dx)&1
+		if color == 0 {
+			continue // transparent
+		}
+		attr := g.spriteAttr[i]
+		return color, 16 | attr&3<<2, attr&32 != 0, i == 0 && g.sprite0Line
+	}
+	return 0, 0, false, false
+}
+
+func reverseBits(b byte) byte {
+	b = b&0xf0>>4 | b&0x0f<<4
+	b = b&0xcc>>2 | b&0x33<<2
+	b = b&0xaa>>1 | b&0x55<<1
+	return b
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sramFlushInterval is how often dirty battery-backed RAM is written to disk
+// while the game is running.
+const sramFlushInterval = 30 * time.Second
+
+// savePath returns the path of the save file with extension ext for the ROM at
+// romPath. If dir is empty, the file is placed next to the ROM.
+func savePath(romPath, dir, ext string) string {
+	name := strings.TrimSuffix(filepath.Base(romPath), filepath.Ext(romPath)) + ext
+	if dir == "" {
+		return filepath.Join(filepath.Dir(romPath), name)
+	}
+	return filepath.Join(dir, name)
+}
+
+// LoadSRAM loads battery-backed PRG RAM from the .sav file at path and
+// remembers path for SaveSRAM. It does nothing if the cartridge has no battery.
+// A missing .sav file is not an error.
+func (g *Game) LoadSRAM(path string) error {
+	if !g.cart.Battery || g.sramSize == 0 {
+		return nil
+	}
+	g.sramPath = path
+	g.sramLastSave = time.Now()
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(b) != g.sramSize {
+		return fmt.Errorf("save file is %d bytes, expected %d", len(b), g.sramSize)
+	}
+	copy(g.prgram, b)
+	return nil
+}
+
+// SaveSRAM atomically writes battery-backed PRG RAM to the .sav file.
+func (g *Game) SaveSRAM() error {
+	if g.sramPath == "" {
+		return nil
+	}
+	if err := writeFileAtomic(g.sramPath, g.prgram[:g.sramSize]); err != nil {
+		return err
+	}
+	g.sramDirty = false
+	g.sramLastSave = time.Now()
+	return nil
+}
+
+// writeFileAtomic writes b to a temporary file and renames it to path, so that
+// a crash never leaves a half-written file behind.
+func writeFileAtomic(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"log/slog"
+	"os"
+)
+
+// Video is recorded to AVI files with the lossless ZMBV codec (DOSBox capture
+// codec), which FFmpeg and most players decode. Every emulated frame is
+// written, and the stream's frame rate is the exact region frame rate, so a
+// recording has one video frame per emulated frame no matter how fast the
+// emulator ran.
+//
+// Each video frame is followed by the audio samples that play during it, as
+// 16-bit mono PCM. There is no APU yet, so the samples are silent, but the
+// audio track already has its final layout and stays in sync with the video.
+
+const (
+	zmbvBlock            = 16  // Block size for delta frames
+	zmbvKeyframeInterval = 300 // Frames between keyframes, for seeking
+	aviMaxSize           = 1<<31 - 1<<20
+	aviSampleRate        = 44100 // Audio samples per second
+)
+
+// zmbvEncoder compresses frames into ZMBV 32bpp. Keyframes start a new zlib
+// stream; delta frames XOR the blocks that changed since the previous frame
+// and continue the stream.
+type zmbvEncoder struct {
+	width, height int
+	cur, prev     []byte // Frames as little-endian 32-bit XRGB, i.e. B, G, R, 0
+	delta         []byte
+	out           bytes.Buffer
+	zw            *zlib.Writer
+	frames        int
+}
+
+func newZMBVEncoder(width, height int) *zmbvEncoder {
+	e := &zmbvEncoder{
+		width:  width,
+		height: height,
+		cur:    make([]byte, width*height*4),
+		prev:   make([]byte, width*height*4),
+	}
+	e.zw = zlib.NewWriter(&e.out)
+	return e
+}
+
+// encode compresses img, which must be width x height, and returns the frame
+// data and whether it is a keyframe. The data is valid until the next call.
+func (e *zmbvEncoder) encode(img *image.RGBA) ([]byte, bool) {
+	e.prev, e.cur = e.cur, e.prev
+	for y := range e.height {
+		row := img.Pix[img.PixOffset(0, y):]
+		for x := range e.width {
+			i := (y*e.width + x) * 4
+			e.cur[i+0] = row[x*4+2]
+			e.cur[i+1] = row[x*4+1]
+			e.cur[i+2] = row[x*4+0]
+			e.cur[i+3] = 0
+		}
+	}
+
+	key := e.frames%zmbvKeyframeInterval == 0
+	e.frames++
+	e.out.Reset()
+	if key {
+		// Flags (keyframe), version 0.1, zlib, 32bpp, block size.
+		e.out.Write([]byte{1, 0, 1, 1, 8, zmbvBlock, zmbvBlock})
+		e.zw.Reset(&e.out)
+		e.zw.Write(e.cur)
+	} else {
+		e.out.WriteByte(0)
+		e.zw.Write(e.encodeDelta())
+	}
+	e.zw.Flush()
+	return e.out.Bytes(), key
+}
+
+// encodeDelta returns the delta frame payload: a motion vector and XOR flag per
+// block, padded to 4 bytes, followed by the XOR data of the changed blocks.
+// Motion vectors are always zero.
+func (e *zmbvEncoder) encodeDelta() []byte {
+	bx := (e.width + zmbvBlock - 1) / zmbvBlock
+	by := (e.height + zmbvBlock - 1) / zmbvBlock
+	vectors := (bx*by*2 + 3) &^ 3
+	e.delta = append(e.delta[:0], make([]byte, vectors)...)
+
+	for y := range by {
+		for x := range bx {
+			x0, y0 := x*zmbvBlock, y*zmbvBlock
+			x1, y1 := min(x0+zmbvBlock, e.width), min(y0+zmbvBlock, e.height)
+			start := len(e.delta)
+			changed := false
+			for py := y0; py < y1; py++ {
+				for i := (py*e.width + x0) * 4; i < (py*e.width+x1)*4; i++ {
+					d := e.cur[i] ^ e.prev[i]
+					changed = changed || d != 0
+					e.delta = append(e.delta, d)
+				}
+			}
+			if changed {
+				e.delta[(y*bx+x)*2] = 1
+			} else {
+				e.delta = e.delta[:start]
+			}
+		}
+	}
+	return e.delta
+}
+
+// aviIndexEntry is an entry of the idx1 chunk.
+type aviIndexEntry struct {
+	id           string // "00dc" for video, "01wb" for audio
+	offset, size uint32
+	key          bool
+}
+
+// aviWriter writes a ZMBV video stream and a PCM audio stream to an AVI file.
+// The headers are rewritten with the final frame and sample counts on Close.
+type aviWriter struct {
+	f             *os.File
+	width, height int
+	rate, scale   uint32
+	enc           *zmbvEncoder
+	moviSize      uint32 // Size of the movi list data so far, including its fourcc
+	maxFrameSize  uint32
+	maxAudioSize  uint32
+	frames        uint32
+	samples       uint64 // Audio samples written so far
+	silence       []byte
+	index         []aviIndexEntry
+}
+
+// aviHeaderSize is the size of everything before the first movi chunk.
+const aviHeaderSize = 12 + 8 + 4 + 8 + 56 + 12 + 8 + 56 + 8 + 40 + 12 + 8 + 56 + 8 + 18 + 12
+
+func createAVI(path string, width, height int, rate, scale uint32) (*aviWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &aviWriter{
+		f:        f,
+		width:    width,
+		height:   height,
+		rate:     rate,
+		scale:    scale,
+		enc:      newZMBVEncoder(width, height),
+		moviSize: 4,
+	}
+	if _, err := f.Write(w.header()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// header returns the AVI headers for the frames written so far.
+func (w *aviWriter) header() []byte {
+	le := binary.LittleEndian
+	b := make([]byte, 0, aviHeaderSize)
+	chunk := func(id string, size int) {
+		b = append(b, id...)
+		b = le.AppendUint32(b, uint32(size))
+	}
+	list := func(id string, size int, typ string) {
+		chunk(id, size)
+		b = append(b, typ...)
+	}
+	frames := w.frames
+	idxSize := 8 + 16*len(w.index)
+
+	list("RIFF", aviHeaderSize-8+int(w.moviSize)-4+idxSize, "AVI ")
+	list("LIST", 4+8+56+12+8+56+8+40+12+8+56+8+18, "hdrl")
+
+	chunk("avih", 56)
+	b = le.AppendUint32(b, uint32(uint64(1e6)*uint64(w.scale)/uint64(w.rate))) // Microseconds per frame
+	b = le.AppendUint32(b, 0)                                                  // Max bytes per second
+	b = le.AppendUint32(b, 0)                                                  // Padding granularity
+	b = le.AppendUint32(b, 0x10)                                               // AVIF_HASINDEX
+	b = le.AppendUint32(b, frames)
+	b = le.AppendUint32(b, 0) // Initial frames
+	b = le.AppendUint32(b, 2) // Streams
+	b = le.AppendUint32(b, max(w.maxFrameSize, w.maxAudioSize))
+	b = le.AppendUint32(b, uint32(w.width))
+	b = le.AppendUint32(b, uint32(w.height))
+	b = append(b, make([]byte, 16)...)
+
+	list("LIST", 4+8+56+8+40, "strl")
+	chunk("strh", 56)
+	b = append(b, "vidsZMBV"...)
+	b = le.AppendUint32(b, 0) // Flags
+	b = le.AppendUint32(b, 0) // Priority and language
+	b = le.AppendUint32(b, 0) // Initial frames
+	b = le.AppendUint32(b, w.scale)
+	b = le.AppendUint32(b, w.rate)
+	b = le.AppendUint32(b, 0) // Start
+	b = le.AppendUint32(b, frames)
+	b = le.AppendUint32(b, w.maxFrameSize)
+	b = le.AppendUint32(b, 0xffffffff) // Quality
+	b = le.AppendUint32(b, 0)          // Sample size
+	b = le.AppendUint16(b, 0)
+	b = le.AppendUint16(b, 0)
+	b = le.AppendUint16(b, uint16(w.width))
+	b = le.AppendUint16(b, uint16(w.height))
+
+	// BITMAPINFOHEADER
+	chunk("strf", 40)
+	b = le.AppendUint32(b, 40)
+	b = le.AppendUint32(b, uint32(w.width))
+	b = le.AppendUint32(b, uint32(w.height))
+	b = le.AppendUint16(b, 1)  // Planes
+	b = le.AppendUint16(b, 32) // Bits per pixel
+	b = append(b, "ZMBV"...)
+	b = le.AppendUint32(b, uint32(w.width*w.height*4))
+	b = append(b, make([]byte, 16)...)
+
+	list("LIST", 4+8+56+8+18, "strl")
+	chunk("strh", 56)
+	b = append(b, "auds"...)
+	b = le.AppendUint32(b, 0) // Handler
+	b = le.AppendUint32(b, 0) // Flags
+	b = le.AppendUint32(b, 0) // Priority and language
+	b = le.AppendUint32(b, 0) // Initial frames
+	b = le.AppendUint32(b, 2) // Scale: bytes per sample
+	b = le.AppendUint32(b, 2*aviSampleRate)
+	b = le.AppendUint32(b, 0) // Start
+	b = le.AppendUint32(b, uint32(w.samples))
+	b = le.AppendUint32(b, w.maxAudioSize)
+	b = le.AppendUint32(b, 0xffffffff) // Quality
+	b = le.AppendUint32(b, 2)          // Sample size
+	b = append(b, make([]byte, 8)...)
+
+	// WAVEFORMATEX
+	chunk("strf", 18)
+	b = le.AppendUint16(b, 1) // WAVE_FORMAT_PCM
+	b = le.AppendUint16(b, 1) // Channels
+	b = le.AppendUint32(b, aviSampleRate)
+	b = le.AppendUint32(b, 2*aviSampleRate) // Bytes per second
+	b = le.AppendUint16(b, 2)               // Block align
+	b = le.AppendUint16(b, 16)              // Bits per sample
+	b = le.AppendUint16(b, 0)               // Extra format bytes
+
+	list("LIST", int(w.moviSize), "movi")
+	return b
+}
+
+// WriteFrame appends a frame and the silent audio that plays during it. img
+// must have the size the AVI was created with.
+func (w *aviWriter) WriteFrame(img *image.RGBA) error {
+	data, key := w.enc.encode(img)
+
+	// Audio runs up to the end of this frame. Rounding the total rather than
+	// each frame's share keeps the streams from drifting apart.
+	end := (uint64(w.frames) + 1) * uint64(w.scale) * aviSampleRate / uint64(w.rate)
+	n := int(end-w.samples) * 2
+	if len(w.silence) < n {
+		w.silence = make([]byte, n)
+	}
+	audio := w.silence[:n]
+
+	size := int64(aviHeaderSize) + int64(w.moviSize) + 16*int64(len(w.index)+2)
+	size += 8 + int64(len(data)+len(data)%2) + 8 + int64(len(audio))
+	if size > aviMaxSize {
+		return errors.New("AVI file too large")
+	}
+
+	if err := w.writeChunk("00dc", data, key); err != nil {
+		return err
+	}
+	if err := w.writeChunk("01wb", audio, true); err != nil {
+		return err
+	}
+	w.frames++
+	w.samples = end
+	w.maxFrameSize = max(w.maxFrameSize, uint32(len(data)))
+	w.maxAudioSize = max(w.maxAudioSize, uint32(len(audio)))
+	return nil
+}
+
+// writeChunk appends a chunk to the movi list and indexes it.
+func (w *aviWriter) writeChunk(id string, data []byte, key bool) error {
+	size := uint32(len(data))
+	var hdr [8]byte
+	copy(hdr[:], id)
+	binary.LittleEndian.PutUint32(hdr[4:], size)
+	if _, err := w.f.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.f.Write(data); err != nil {
+		return err
+	}
+	if size%2 != 0 {
+		if _, err := w.f.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+
+	w.index = append(w.index, aviIndexEntry{id: id, offset: w.moviSize, size: size, key: key})
+	w.moviSize += 8 + size + size%2
+	return nil
+}
+
+// Close writes the index and the final headers and closes the file.
+func (w *aviWriter) Close() error {
+	b := make([]byte, 0, 8+16*len(w.index))
+	b = append(b, "idx1"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(16*len(w.index)))
+	for _, e := range w.index {
+		b = append(b, e.id...)
+		var flags uint32
+		if e.key {
+			flags = 0x10 // AVIIF_KEYFRAME
+		}
+		b = binary.LittleEndian.AppendUint32(b, flags)
+		b = binary.LittleEndian.AppendUint32(b, e.offset)
+		b = binary.LittleEndian.AppendUint32(b, e.size)
+	}
+	_, err := w.f.Write(b)
+	if err == nil {
+		_, err = w.f.WriteAt(w.header(), 0)
+	}
+	return errors.Join(err, w.f.Close())
+}
+
+// StartVideo starts recording every emulated frame to an AVI file at path.
+func (g *Game) StartVideo(path string) error {
+	r := g.frameRect()
+	w, err := createAVI(path, r.Dx(), r.Dy(), g.region.FrameRateNum, g.region.FrameRateDen)
+	if err != nil {
+		return err
+	}
+	g.video = w
+	return nil
+}
+
+// StopVideo finishes the video being recorded, if any.
+func (g *Game) StopVideo() error {
+	if g.video == nil {
+		return nil
+	}
+	err := g.video.Close()
+	g.video = nil
+	return err
+}
+
+// writeVideoFrame appends the frame that just finished to the video. Recording
+// stops if that fails.
+func (g *Game) writeVideoFrame() {
+	if err := g.video.WriteFrame(g.Frame().(*image.RGBA)); err != nil {
+		slog.Error("failed to write video frame, stopping recording", "error", err)
+		if err := g.StopVideo(); err != nil {
+			slog.Error("failed to finish video", "error", err)
+		}
+	}
+}
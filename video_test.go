@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAVIStreams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.avi")
+	w, err := createAVI(path, 32, 16, RegionNTSC.FrameRateNum, RegionNTSC.FrameRateDen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	const frames = 120
+	for i := range frames {
+		img.Pix[i] = 0xff
+		if err := w.WriteFrame(img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := binary.LittleEndian
+	if string(b[:4]) != "RIFF" || int(le.Uint32(b[4:])) != len(b)-8 {
+		t.Fatalf("RIFF size = %d, want %d", le.Uint32(b[4:]), len(b)-8)
+	}
+
+	// Walk the movi list and count the chunks of each stream.
+	movi := aviHeaderSize - 4
+	if string(b[movi-8:movi-4]) != "LIST" || string(b[movi:movi+4]) != "movi" {
+		t.Fatalf("no movi list at %d", movi-8)
+	}
+	end := movi + int(le.Uint32(b[movi-4:]))
+	var video, samples int
+	for i := movi + 4; i < end; {
+		size := int(le.Uint32(b[i+4:]))
+		switch string(b[i : i+4]) {
+		case "00dc":
+			video++
+		case "01wb":
+			samples += size / 2
+		default:
+			t.Fatalf("unexpected chunk %q in movi list", b[i:i+4])
+		}
+		i += 8 + size + size%2
+	}
+	if string(b[end:end+4]) != "idx1" || int(le.Uint32(b[end+4:])) != 16*2*frames {
+		t.Errorf("idx1 chunk missing or has the wrong size")
+	}
+
+	// 120 NTSC frames last 120 * 655171 / 39375000 seconds.
+	wantSamples := frames * 655171 * aviSampleRate / 39375000
+	if video != frames || samples != wantSamples {
+		t.Errorf("got %d frames and %d samples, want %d and %d", video, samples, frames, wantSamples)
+	}
+}